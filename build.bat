@@ -1,7 +1,15 @@
+del examples\capacity\capacity.exe
 del examples\grpc\client\client.exe
 del examples\grpc\server\server.exe
 del examples\http\client\client.exe
-cd examples\grpc\client && go build -gcflags "-N -l"
+del examples\mock\mock.exe
+del examples\mq\mq.exe
+del examples\ws\client\client.exe
+cd examples\capacity && go build -gcflags "-N -l"
+cd ..\grpc\client && go build -gcflags "-N -l"
 cd ..\server && go build -gcflags "-N -l"
 cd ..\..\http\client && go build -gcflags "-N -l"
+cd ..\..\mock && go build -gcflags "-N -l"
+cd ..\mq && go build -gcflags "-N -l"
+cd ..\ws\client && go build -gcflags "-N -l"
 cd ..\..\..\
\ No newline at end of file
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+
+	kite "github.com/xingshuo/kite/pkg"
+)
+
+var (
+	hostUrl   string
+	mode      string
+	dimension string
+	min, max  float64
+	workers   int
+	stageSec  int
+	sloP99    float64
+	sloErr    float64
+)
+
+type ReqHandler struct {
+	client  *http.Client
+	httpReq *http.Request
+}
+
+func (rh *ReqHandler) Init(req *kite.Request, results chan<- *kite.Response) error {
+	rh.client = &http.Client{
+		Transport: kite.HTTPClientInterceptor(results, http.DefaultTransport, nil),
+	}
+	httpReq, err := http.NewRequest("GET", req.Url, nil)
+	if err != nil {
+		return err
+	}
+	rh.httpReq = httpReq
+	return nil
+}
+
+func (rh *ReqHandler) OnRequest() error {
+	return rh.OnRequestContext(context.Background())
+}
+
+func (rh *ReqHandler) OnRequestContext(ctx context.Context) error {
+	rsp, err := rh.client.Do(rh.httpReq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (rh *ReqHandler) Close() {
+}
+
+func init() {
+	flag.StringVar(&hostUrl, "host", "http://localhost:8080/", "target url")
+	flag.StringVar(&mode, "mode", "binary", "search mode: binary | aimd")
+	flag.StringVar(&dimension, "dim", "concurrency", "search dimension: concurrency | rate")
+	flag.Float64Var(&min, "min", 1, "search lower bound")
+	flag.Float64Var(&max, "max", 200, "search upper bound")
+	flag.IntVar(&workers, "c", 100, "worker num when searching rate")
+	flag.IntVar(&stageSec, "stage", 10, "stage seconds")
+	flag.Float64Var(&sloP99, "p99", 100, "slo p99 latency ms")
+	flag.Float64Var(&sloErr, "err", 0.005, "slo max error rate")
+}
+
+func main() {
+	flag.Parse()
+	cfg := &kite.CapacityConfig{
+		Base: &kite.Config{
+			ConcurrencyNum:    workers,
+			ResultsBufferSize: 1024,
+			RequestTimeoutMS:  5000,
+		},
+		Min:      min,
+		Max:      max,
+		StageSec: stageSec,
+		SLO:      kite.SLO{LatencyMS: sloP99, MaxErrorRate: sloErr},
+	}
+	if mode == "aimd" {
+		cfg.Mode = kite.SearchAIMD
+	}
+	if dimension == "rate" {
+		cfg.Dimension = kite.SearchRate
+	}
+	s := kite.NewServer()
+	if _, err := s.SearchCapacity(cfg, &kite.Request{Url: hostUrl}, func() kite.ReqHandler {
+		return &ReqHandler{}
+	}); err != nil {
+		log.Fatalf("search failed:%v\n", err)
+	}
+}
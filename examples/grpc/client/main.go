@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"log"
 
-	pb "github.com/xingshuo/kite/examples/grpc/proto"
 	kite "github.com/xingshuo/kite/pkg"
+	pb "github.com/xingshuo/kite/pkg/mock/proto"
 	"google.golang.org/grpc"
 )
 
@@ -15,18 +15,66 @@ var (
 	concyNum       int
 	reqNumPerConcy int
 	hostUrl        string
+	checks         checkFlags
+	failOnCheck    bool
+	extracts       extractFlags
+	name           string
+	bearer         string
+	jwtKey         string
+	auth           kite.AuthProvider
 )
 
+// 可重复指定的-check参数
+type checkFlags []kite.Check
+
+func (c *checkFlags) String() string {
+	return fmt.Sprint(len(*c))
+}
+
+func (c *checkFlags) Set(spec string) error {
+	check, err := kite.ParseCheck(spec)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, check)
+	return nil
+}
+
+// 可重复指定的-extract参数
+type extractFlags []kite.Extractor
+
+func (e *extractFlags) String() string {
+	return fmt.Sprint(len(*e))
+}
+
+func (e *extractFlags) Set(spec string) error {
+	ex, err := kite.ParseExtractor(spec)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, ex)
+	return nil
+}
+
 type ReqHandler struct {
 	conn   *grpc.ClientConn
 	client pb.GreeterClient
+	vars   *kite.Vars
 }
 
 func (rh *ReqHandler) Init(req *kite.Request, results chan<- *kite.Response) error {
+	// 每个worker一份变量, 上一次响应中提取的值可在下一次请求中以${name}引用
+	rh.vars = kite.NewVars()
+	filter := kite.GRPCExtractFilter(rh.vars, extracts, failOnCheck, kite.GRPCCheckFilter(checks, failOnCheck, nil))
+	interceptors := []grpc.UnaryClientInterceptor{kite.GRPCClientInterceptor(results, filter)}
+	if auth != nil {
+		// 认证拦截器在外层, 获取token的耗时不计入接口延迟
+		interceptors = append([]grpc.UnaryClientInterceptor{kite.GRPCAuthInterceptor(auth, results)}, interceptors...)
+	}
 	conn, err := grpc.Dial(
 		req.Url,
 		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(kite.GRPCClientInterceptor(results, nil)),
+		grpc.WithChainUnaryInterceptor(interceptors...),
 	)
 	if err != nil {
 		return err
@@ -37,7 +85,12 @@ func (rh *ReqHandler) Init(req *kite.Request, results chan<- *kite.Response) err
 }
 
 func (rh *ReqHandler) OnRequest() error {
-	_, err := rh.client.SayHello(context.Background(), &pb.HelloRequest{Name: "lake"})
+	return rh.OnRequestContext(context.Background())
+}
+
+// ctx中带有虚拟用户信息, 按用户签名的jwt据此区分
+func (rh *ReqHandler) OnRequestContext(ctx context.Context) error {
+	_, err := rh.client.SayHello(ctx, &pb.HelloRequest{Name: rh.vars.Expand(name)})
 	return err
 }
 
@@ -49,10 +102,21 @@ func init() {
 	flag.IntVar(&concyNum, "c", 20, "concurrency num")
 	flag.IntVar(&reqNumPerConcy, "n", 50, "per concurrency req num")
 	flag.StringVar(&hostUrl, "host", "localhost:5051", "target url")
+	flag.Var(&checks, "check", "response check, repeatable: status:0 | proto:message=Hello lake | size:min[,max]")
+	flag.BoolVar(&failOnCheck, "check-fail", false, "count requests failing a check as failures")
+	flag.Var(&extracts, "extract", "extract a response field into a variable, repeatable: var=proto:message")
+	flag.StringVar(&name, "name", "lake", "request name, may reference variables like ${var}")
+	flag.StringVar(&bearer, "bearer", "", "static bearer token sent as authorization metadata")
+	flag.StringVar(&jwtKey, "jwt-key", "", "sign a HS256 jwt per virtual user with this secret")
 }
 
 func main() {
 	flag.Parse()
+	if bearer != "" {
+		auth = kite.BearerToken(bearer)
+	} else if jwtKey != "" {
+		auth = &kite.JWTSigner{Key: []byte(jwtKey), Claims: map[string]interface{}{"sub": "kite"}}
+	}
 	s := kite.NewServer()
 	// test redirect log func
 	s.RedirectLog(func(format string, a ...interface{}) (n int, err error) {
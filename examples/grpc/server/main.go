@@ -6,7 +6,7 @@ import (
 	"log"
 	"net"
 
-	pb "github.com/xingshuo/kite/examples/grpc/proto"
+	pb "github.com/xingshuo/kite/pkg/mock/proto"
 	"google.golang.org/grpc"
 )
 
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
-	"time"
 
 	kite "github.com/xingshuo/kite/pkg"
 )
@@ -15,21 +18,65 @@ var (
 	concyNum       int
 	reqNumPerConcy int
 	hostUrl        string
+	timeoutMS      int
+	maxAttempts    int
+	arrival        string
+	durationSec    int
+	harPath        string
+	curlPath       string
+	domains        string
+	replay         string
+	accessLog      string
+	logFormat      string
+	speed          float64
+	checks         checkFlags
+	failOnCheck    bool
+	bearer         string
+	oauthURL       string
+	clientID       string
+	clientSecret   string
+	jwtAlg         string
+	jwtKey         string
+	feederPath     string
+	certFile       string
+	keyFile        string
+	caFile         string
+	insecure       bool
+	auth           kite.AuthProvider
+	tlsConfig      *tls.Config
 )
 
+// 可重复指定的-check参数
+type checkFlags []kite.Check
+
+func (c *checkFlags) String() string {
+	return fmt.Sprint(len(*c))
+}
+
+func (c *checkFlags) Set(spec string) error {
+	check, err := kite.ParseCheck(spec)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, check)
+	return nil
+}
+
 type ReqHandler struct {
 	client  *http.Client
 	httpReq *http.Request
 }
 
 func (rh *ReqHandler) Init(req *kite.Request, results chan<- *kite.Response) error {
-	// 跳过证书验证
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: tlsConfig.Clone(),
+	}
+	var rt http.RoundTripper = kite.HTTPClientInterceptor(results, tr, nil)
+	if auth != nil {
+		rt = kite.HTTPAuthTransport(auth, results, rt)
 	}
 	rh.client = &http.Client{
-		Transport: kite.HTTPClientInterceptor(results, tr, nil),
-		Timeout:   5 * time.Second,
+		Transport: rt,
 	}
 	headers := make(map[string]string)
 	headers["Content-Type"] = "application/x-www-form-urlencoded; charset=utf-8"
@@ -45,8 +92,20 @@ func (rh *ReqHandler) Init(req *kite.Request, results chan<- *kite.Response) err
 }
 
 func (rh *ReqHandler) OnRequest() error {
-	_, err := rh.client.Do(rh.httpReq)
-	return err
+	return rh.OnRequestContext(context.Background())
+}
+
+// 超时由调度器通过ctx控制, 拦截器据此区分首次请求与重试
+func (rh *ReqHandler) OnRequestContext(ctx context.Context) error {
+	rsp, err := rh.client.Do(rh.httpReq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 500 {
+		return fmt.Errorf("http status %d", rsp.StatusCode)
+	}
+	return nil
 }
 
 func (rh *ReqHandler) Close() {
@@ -56,14 +115,174 @@ func init() {
 	flag.IntVar(&concyNum, "c", 20, "concurrency num")
 	flag.IntVar(&reqNumPerConcy, "n", 50, "per concurrency req num")
 	flag.StringVar(&hostUrl, "host", "https://www.baidu.com", "target url")
+	flag.IntVar(&timeoutMS, "timeout", 5000, "per request timeout ms")
+	flag.IntVar(&maxAttempts, "attempts", 1, "max attempts per request")
+	flag.StringVar(&arrival, "arrival", "", "open-loop arrival process: const:100 | poisson:100 | onoff:500,0,1s,4s[,poisson] | sine:100,50,60s[,poisson]")
+	flag.IntVar(&durationSec, "d", 0, "duration seconds, 0 unlimited")
+	flag.StringVar(&harPath, "har", "", "replay requests recorded in a HAR file")
+	flag.StringVar(&curlPath, "curl", "", "replay a file of curl commands")
+	flag.StringVar(&domains, "domains", "", "comma separated domains to keep when importing, empty keeps all")
+	flag.StringVar(&replay, "replay", "full", "scenario pacing: full | original")
+	flag.StringVar(&accessLog, "access-log", "", "replay requests in an access log with original inter-arrival times")
+	flag.StringVar(&logFormat, "log-format", "combined", "access log format: combined | json")
+	flag.Float64Var(&speed, "speed", 1, "access log replay speed, 2 halves the intervals")
+	flag.Var(&checks, "check", "response check for imported requests, repeatable: status:200,201 | contains:ok | regex:re | json:path=value | header:name | size:min[,max]")
+	flag.BoolVar(&failOnCheck, "check-fail", false, "count requests failing a check as failures")
+	flag.StringVar(&bearer, "bearer", "", "static bearer token")
+	flag.StringVar(&oauthURL, "oauth-url", "", "oauth2 client credentials token endpoint")
+	flag.StringVar(&clientID, "client-id", "", "oauth2 client id")
+	flag.StringVar(&clientSecret, "client-secret", "", "oauth2 client secret")
+	flag.StringVar(&jwtAlg, "jwt-alg", "HS256", "jwt signing algorithm: HS256 | RS256")
+	flag.StringVar(&jwtKey, "jwt-key", "", "sign a jwt per virtual user: HS256 secret, or RS256 private key PEM file")
+	flag.StringVar(&feederPath, "feeder", "", "csv file with a header row, one record per virtual user as jwt claims")
+	flag.StringVar(&certFile, "cert", "", "client certificate file for mTLS")
+	flag.StringVar(&keyFile, "key", "", "client key file for mTLS")
+	flag.StringVar(&caFile, "ca", "", "CA file to verify the server certificate")
+	flag.BoolVar(&insecure, "insecure", false, "skip server certificate verification")
+}
+
+// 按参数选择认证方式, 未指定时返回nil
+func newAuth() (kite.AuthProvider, error) {
+	switch {
+	case bearer != "":
+		return kite.BearerToken(bearer), nil
+	case oauthURL != "":
+		return &kite.OAuth2ClientCredentials{
+			TokenURL:     oauthURL,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Client:       &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig.Clone()}},
+		}, nil
+	case jwtKey != "":
+		signer := &kite.JWTSigner{Algorithm: jwtAlg, Key: []byte(jwtKey)}
+		if jwtAlg == "RS256" {
+			data, err := ioutil.ReadFile(jwtKey)
+			if err != nil {
+				return nil, err
+			}
+			if signer.RSAKey, err = kite.ParseRSAPrivateKey(data); err != nil {
+				return nil, err
+			}
+			signer.Key = nil
+		}
+		if feederPath != "" {
+			f, err := os.Open(feederPath)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			feeder, err := kite.LoadCSVFeeder(f)
+			if err != nil {
+				return nil, err
+			}
+			signer.Feeder = feeder
+		}
+		return signer, nil
+	}
+	return nil, nil
+}
+
+// 由HAR或curl命令文件生成内置http场景handler, -host非空时替换请求的scheme及host
+func newScenarioHandler() (kite.NewReqHandlerFunc, error) {
+	path, load := harPath, kite.LoadHAR
+	if path == "" {
+		path, load = curlPath, kite.LoadCurl
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opt := &kite.HTTPImportOptions{}
+	if domains != "" {
+		opt.Domains = strings.Split(domains, ",")
+	}
+	sc, err := load(f, opt)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &kite.HTTPHandlerConfig{Scenario: sc, Checks: checks, FailOnCheck: failOnCheck, TLS: tlsConfig, Auth: auth}
+	if replay == "original" {
+		cfg.Replay = kite.ReplayOriginal
+	}
+	return kite.NewHTTPHandler(cfg), nil
+}
+
+// 读取访问日志, 按原始间隔(可缩放)回放, 统计项按归一化的接口区分
+func newAccessLogHandler(cfg *kite.Config) (kite.NewReqHandlerFunc, error) {
+	f, err := os.Open(accessLog)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opt := &kite.AccessLogOptions{}
+	if logFormat == "json" {
+		opt.Format = kite.AccessLogJSON
+	}
+	l, err := kite.LoadAccessLog(f, opt)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("access log: %d requests, %d lines skipped\n", len(l.Entries), l.Skipped)
+	cfg.ReqNumPerConcy = 0
+	l.Apply(cfg, speed)
+	return kite.NewAccessLogHandler(&kite.AccessLogReplayConfig{Log: l, Checks: checks, FailOnCheck: failOnCheck, TLS: tlsConfig, Auth: auth}), nil
 }
 
 func main() {
 	flag.Parse()
+	var err error
+	ct := &kite.ClientTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, InsecureSkipVerify: insecure}
+	if tlsConfig, err = ct.Config(); err != nil {
+		log.Fatalf("tls config: %v", err)
+	}
+	if auth, err = newAuth(); err != nil {
+		log.Fatalf("auth: %v", err)
+	}
 	s := kite.NewServer()
-	_, err := s.RunWithSimpleArgs(hostUrl, concyNum, reqNumPerConcy, func() kite.ReqHandler {
+	cfg := &kite.Config{
+		ConcurrencyNum:    concyNum,
+		ResultsBufferSize: 1024,
+		ReqNumPerConcy:    reqNumPerConcy,
+		RequestTimeoutMS:  timeoutMS,
+		DurationSec:       durationSec,
+	}
+	if maxAttempts > 1 {
+		cfg.Retry = &kite.RetryPolicy{
+			MaxAttempts: maxAttempts,
+			BackoffMS:   50,
+			Jitter:      0.5,
+		}
+	}
+	if arrival != "" {
+		a, err := kite.ParseArrival(arrival)
+		if err != nil {
+			log.Fatalf("parse arrival: %v", err)
+		}
+		cfg.Arrival = a
+	}
+	newHandler := func() kite.ReqHandler {
 		return &ReqHandler{}
-	})
+	}
+	target := hostUrl
+	if accessLog != "" || harPath != "" || curlPath != "" {
+		h, err := newScenarioHandler()
+		if accessLog != "" {
+			h, err = newAccessLogHandler(cfg)
+		}
+		if err != nil {
+			log.Fatalf("import scenario: %v", err)
+		}
+		newHandler = h
+		// 未指定-host时按录制的地址回放
+		target = ""
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "host" {
+				target = hostUrl
+			}
+		})
+	}
+	_, err = s.Run(cfg, &kite.Request{Url: target}, newHandler)
 	if err != nil {
 		log.Fatalf("run failed:%v\n", err)
 	}
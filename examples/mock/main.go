@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	kite "github.com/xingshuo/kite/pkg"
+	"github.com/xingshuo/kite/pkg/mock"
+	pb "github.com/xingshuo/kite/pkg/mock/proto"
+	"google.golang.org/grpc"
+)
+
+var (
+	httpAddr   string
+	grpcAddr   string
+	latency    string
+	httpErrors string
+	grpcErrors string
+	size       int
+	bandwidth  int64
+	seed       int64
+	clientID   string
+	secret     string
+	tokenTTL   time.Duration
+)
+
+func init() {
+	flag.StringVar(&httpAddr, "http", "localhost:8080", "http listen addr, empty to disable")
+	flag.StringVar(&grpcAddr, "grpc", "localhost:5051", "grpc listen addr, empty to disable")
+	flag.StringVar(&latency, "latency", "fixed:0s", "latency distribution: fixed:10ms | uniform:5ms,15ms | exp:10ms[,1s] | normal:10ms,2ms | longtail:5ms,1.5[,1s]")
+	flag.StringVar(&httpErrors, "http-errors", "", "http error rates, e.g. 500:0.01,503:0.005")
+	flag.StringVar(&grpcErrors, "grpc-errors", "", "grpc error rates, e.g. 14:0.01")
+	flag.IntVar(&size, "size", 64, "response size in bytes")
+	flag.Int64Var(&bandwidth, "bw", 0, "bandwidth limit per response in bytes/second, 0 unlimited")
+	flag.Int64Var(&seed, "seed", 1, "random seed")
+	flag.StringVar(&clientID, "client-id", "", "serve oauth2 client credentials token endpoint at /oauth/token and require bearer tokens on other paths")
+	flag.StringVar(&secret, "client-secret", "", "oauth2 client secret")
+	flag.DurationVar(&tokenTTL, "token-ttl", time.Hour, "oauth2 token lifetime")
+}
+
+func newProfile(errorSpec string) *mock.Profile {
+	dist, err := kite.ParseDistribution(latency)
+	if err != nil {
+		log.Fatalf("parse latency: %v", err)
+	}
+	rates, err := mock.ParseErrorRates(errorSpec)
+	if err != nil {
+		log.Fatalf("parse error rates: %v", err)
+	}
+	return &mock.Profile{
+		Latency:      dist,
+		ErrorRates:   rates,
+		ResponseSize: size,
+		BandwidthBPS: bandwidth,
+		Seed:         seed,
+	}
+}
+
+func main() {
+	flag.Parse()
+	if httpAddr == "" && grpcAddr == "" {
+		log.Fatalf("both http and grpc are disabled")
+	}
+	errCh := make(chan error, 2)
+	if httpAddr != "" {
+		handler := mock.NewHTTPHandler(newProfile(httpErrors))
+		if clientID != "" {
+			issuer := &mock.TokenIssuer{ClientID: clientID, ClientSecret: secret, TTL: tokenTTL}
+			mux := http.NewServeMux()
+			mux.Handle("/oauth/token", issuer)
+			mux.Handle("/", issuer.RequireToken(handler))
+			handler = mux
+		}
+		log.Printf("http serving on %s\n", httpAddr)
+		go func() {
+			errCh <- http.ListenAndServe(httpAddr, handler)
+		}()
+	}
+	if grpcAddr != "" {
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatalf("failed to listen: %v", err)
+		}
+		s := grpc.NewServer()
+		pb.RegisterGreeterServer(s, mock.NewGreeterServer(newProfile(grpcErrors)))
+		log.Printf("grpc serving on %s\n", grpcAddr)
+		go func() {
+			errCh <- s.Serve(lis)
+		}()
+	}
+	log.Fatalf("failed to serve: %v", <-errCh)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	kite "github.com/xingshuo/kite/pkg"
+)
+
+var (
+	concyNum       int
+	reqNumPerConcy int
+	natsAddr       string
+	topic          string
+	payloadSize    int
+	consumerNum    int
+)
+
+func init() {
+	flag.IntVar(&concyNum, "c", 20, "producer num")
+	flag.IntVar(&reqNumPerConcy, "n", 50, "per producer message num")
+	flag.StringVar(&natsAddr, "nats", "", "nats server addr, empty to use in-process broker")
+	flag.StringVar(&topic, "topic", "kite.bench", "topic")
+	flag.IntVar(&payloadSize, "size", 128, "payload size")
+	flag.IntVar(&consumerNum, "consumers", 4, "consumer num")
+}
+
+func main() {
+	flag.Parse()
+	newBroker := kite.NewMemoryHub().NewBroker
+	if natsAddr != "" {
+		newBroker = kite.NATSBroker(natsAddr)
+	}
+	t := kite.NewMQTest(&kite.MQConfig{
+		NewBroker:   newBroker,
+		Topic:       topic,
+		PayloadSize: payloadSize,
+		ConsumerNum: consumerNum,
+	})
+	s := kite.NewServer()
+	_, _, err := t.Run(s, &kite.Config{
+		ConcurrencyNum:    concyNum,
+		ResultsBufferSize: 1024,
+		ReqNumPerConcy:    reqNumPerConcy,
+	})
+	if err != nil {
+		log.Fatalf("run failed:%v\n", err)
+	}
+	log.Println("run done")
+}
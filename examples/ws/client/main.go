@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"strconv"
+
+	kite "github.com/xingshuo/kite/pkg"
+)
+
+var (
+	concyNum       int
+	reqNumPerConcy int
+	hostUrl        string
+)
+
+// 以json中的seq字段关联请求与响应, 没有seq的消息视为服务端推送
+type message struct {
+	Seq  string `json:"seq,omitempty"`
+	Data string `json:"data"`
+}
+
+func init() {
+	flag.IntVar(&concyNum, "c", 20, "concurrency num")
+	flag.IntVar(&reqNumPerConcy, "n", 50, "per concurrency req num")
+	flag.StringVar(&hostUrl, "host", "ws://localhost:8080/echo", "target url")
+}
+
+func main() {
+	flag.Parse()
+	cfg := &kite.WSHandlerConfig{
+		Method: "echo",
+		NewMessage: func(seq int) (string, []byte) {
+			id := strconv.Itoa(seq)
+			msg, _ := json.Marshal(&message{Seq: id, Data: "hello"})
+			return id, msg
+		},
+	}
+	cfg.Correlate = func(msg []byte) (string, bool) {
+		var m message
+		if json.Unmarshal(msg, &m) != nil || m.Seq == "" {
+			return "", false
+		}
+		return m.Seq, true
+	}
+	s := kite.NewServer()
+	_, err := s.RunWithSimpleArgs(hostUrl, concyNum, reqNumPerConcy, kite.NewWSHandler(cfg))
+	if err != nil {
+		log.Fatalf("run failed:%v\n", err)
+	}
+	log.Println("run done")
+}
@@ -0,0 +1,331 @@
+package kite
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 访问日志格式
+type AccessLogFormat int
+
+const (
+	AccessLogCombined AccessLogFormat = iota // nginx/apache的common及combined格式
+	AccessLogJSON                            // 每行一个json对象, 字段由AccessLogFields指定
+)
+
+// json访问日志的字段映射, 支持以.分隔的嵌套字段, 如request.method
+type AccessLogFields struct {
+	Time string // 默认time
+	// 时间格式, 默认RFC3339; unix及unix_ms表示秒及毫秒时间戳(可为小数或字符串)
+	TimeLayout string
+	Method     string            // 默认method
+	URL        string            // 路径(含查询参数)或完整url, 默认url
+	Host       string            // 默认host, 日志中无该字段时需通过Request.Url指定目标
+	Body       string            // 请求体字段, 为空时不回放请求体
+	Headers    map[string]string // 请求头名 -> 字段名
+}
+
+func (f *AccessLogFields) setDefaults() {
+	if f.Time == "" {
+		f.Time = "time"
+	}
+	if f.TimeLayout == "" {
+		f.TimeLayout = time.RFC3339
+	}
+	if f.Method == "" {
+		f.Method = "method"
+	}
+	if f.URL == "" {
+		f.URL = "url"
+	}
+	if f.Host == "" {
+		f.Host = "host"
+	}
+}
+
+type AccessLogOptions struct {
+	Format AccessLogFormat
+	Fields AccessLogFields // AccessLogJSON时有效
+}
+
+// 访问日志中的一个请求
+type AccessLogEntry struct {
+	Time   time.Time
+	Method string
+	URL    string // 路径(含查询参数)或完整url
+	Host   string
+	Header http.Header
+	Body   []byte
+}
+
+// 按时间排序的访问日志
+type AccessLog struct {
+	Entries []*AccessLogEntry
+	Skipped int // 无法解析而跳过的行数
+}
+
+// common: host ident user [time] "request" status bytes
+// combined: 在common之后追加 "referer" "user-agent"
+var combinedLogLine = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)(?: [^"]*)?" \S+ \S+(?: "([^"]*)" "([^"]*)")?`)
+
+const combinedLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// 读取访问日志, 跳过无法解析的行及非http请求行, 按请求时间排序
+func LoadAccessLog(r io.Reader, opt *AccessLogOptions) (*AccessLog, error) {
+	fields := opt.Fields
+	fields.setDefaults()
+	l := &AccessLog{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry *AccessLogEntry
+		var err error
+		if opt.Format == AccessLogJSON {
+			entry, err = parseJSONLogLine(line, &fields)
+		} else {
+			entry, err = parseCombinedLogLine(line)
+		}
+		if err != nil {
+			l.Skipped++
+			continue
+		}
+		l.Entries = append(l.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.Entries) == 0 {
+		return nil, fmt.Errorf("access log: no valid entry, %d lines skipped", l.Skipped)
+	}
+	sort.SliceStable(l.Entries, func(i, j int) bool { return l.Entries[i].Time.Before(l.Entries[j].Time) })
+	return l, nil
+}
+
+func parseCombinedLogLine(line string) (*AccessLogEntry, error) {
+	m := combinedLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return nil, errors.New("invalid combined log line")
+	}
+	t, err := time.Parse(combinedLogTime, m[1])
+	if err != nil {
+		return nil, err
+	}
+	entry := &AccessLogEntry{Time: t, Method: m[2], URL: m[3], Header: make(http.Header)}
+	if m[4] != "" && m[4] != "-" {
+		entry.Header.Set("Referer", m[4])
+	}
+	if m[5] != "" && m[5] != "-" {
+		entry.Header.Set("User-Agent", m[5])
+	}
+	return entry, nil
+}
+
+func parseJSONLogLine(line string, fields *AccessLogFields) (*AccessLogEntry, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	t, err := parseLogTime(jsonField(obj, fields.Time), fields.TimeLayout)
+	if err != nil {
+		return nil, err
+	}
+	entry := &AccessLogEntry{
+		Time:   t,
+		Method: jsonString(jsonField(obj, fields.Method)),
+		URL:    jsonString(jsonField(obj, fields.URL)),
+		Host:   jsonString(jsonField(obj, fields.Host)),
+		Header: make(http.Header),
+	}
+	if entry.Method == "" || entry.URL == "" {
+		return nil, errors.New("missing method or url")
+	}
+	if fields.Body != "" {
+		entry.Body = []byte(jsonString(jsonField(obj, fields.Body)))
+	}
+	for name, field := range fields.Headers {
+		if v := jsonString(jsonField(obj, field)); v != "" {
+			entry.Header.Set(name, v)
+		}
+	}
+	return entry, nil
+}
+
+// 按.分隔的路径取嵌套字段, 不存在时为nil
+func jsonField(obj map[string]interface{}, path string) interface{} {
+	var v interface{} = obj
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func jsonString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	default:
+		b, _ := json.Marshal(x)
+		return string(b)
+	}
+}
+
+func parseLogTime(v interface{}, layout string) (time.Time, error) {
+	s := jsonString(v)
+	if s == "" {
+		return time.Time{}, errors.New("missing time")
+	}
+	switch layout {
+	case "unix", "unix_ms":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if layout == "unix_ms" {
+			f /= 1e3
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	default:
+		return time.Parse(layout, s)
+	}
+}
+
+// 保留原始到达间隔的到达过程, speed为时间压缩倍数: 2表示间隔减半, 0.5表示间隔加倍
+func (l *AccessLog) Arrival(speed float64) *TraceArrival {
+	trace := &TraceArrival{Speed: speed, Offsets: make([]time.Duration, len(l.Entries))}
+	for i, e := range l.Entries {
+		trace.Offsets[i] = e.Time.Sub(l.Entries[0].Time)
+	}
+	return trace
+}
+
+// 将回放所需的配置填入cfg: 按原始间隔的开环到达过程, 未指定请求数及时长时回放全部请求
+// 未配置URLRules时按归一化的接口(去掉查询参数, 识别id段)统计
+func (l *AccessLog) Apply(cfg *Config, speed float64) {
+	cfg.Arrival = l.Arrival(speed)
+	if cfg.ReqNumPerConcy == 0 && cfg.DurationSec == 0 {
+		if cfg.ConcurrencyNum <= 0 {
+			cfg.ConcurrencyNum = 1
+		}
+		cfg.ReqNumPerConcy = (len(l.Entries) + cfg.ConcurrencyNum - 1) / cfg.ConcurrencyNum
+	}
+	if cfg.URLRules == nil {
+		cfg.URLRules = &URLRules{DropQuery: true, AutoID: true}
+	}
+}
+
+type AccessLogReplayConfig struct {
+	Log *AccessLog
+	// 同HTTPHandlerConfig
+	NewTransport func() http.RoundTripper
+	TLS          *tls.Config
+	Auth         AuthProvider
+	Filter       func(result *Response, req *http.Request, rsp *http.Response, err error)
+	Checks       []Check
+	FailOnCheck  bool
+}
+
+// 所有worker共享的回放位置, 以结果channel区分每次运行, 新的运行从头回放
+type accessLogCursor struct {
+	mu   sync.Mutex
+	run  chan<- *Response
+	next uint64
+}
+
+func (c *accessLogCursor) begin(results chan<- *Response) {
+	c.mu.Lock()
+	if c.run != results {
+		c.run = results
+		c.next = 0
+	}
+	c.mu.Unlock()
+}
+
+func (c *accessLogCursor) advance() uint64 {
+	c.mu.Lock()
+	i := c.next
+	c.next++
+	c.mu.Unlock()
+	return i
+}
+
+type accessLogHandler struct {
+	*httpHandler
+	log    *AccessLog
+	cursor *accessLogCursor
+	entry  *AccessLogEntry // 本次请求的日志项, 重试时重发
+}
+
+// 按日志顺序回放请求, 所有worker共享回放位置, 全部回放后从头循环, 重试时重发同一日志项
+// 同一handler用于多次Run时每次都从第一条日志开始
+// Request.Url非空时以其scheme及host替换请求的目标, 否则使用日志中的host
+func NewAccessLogHandler(cfg *AccessLogReplayConfig) NewReqHandlerFunc {
+	newHTTP := NewHTTPHandler(&HTTPHandlerConfig{
+		NewTransport: cfg.NewTransport,
+		TLS:          cfg.TLS,
+		Auth:         cfg.Auth,
+		Filter:       cfg.Filter,
+		Checks:       cfg.Checks,
+		FailOnCheck:  cfg.FailOnCheck,
+	})
+	cursor := &accessLogCursor{}
+	return func() ReqHandler {
+		return &accessLogHandler{httpHandler: newHTTP().(*httpHandler), log: cfg.Log, cursor: cursor}
+	}
+}
+
+func (h *accessLogHandler) Init(req *Request, results chan<- *Response) error {
+	h.cursor.begin(results)
+	return h.httpHandler.Init(req, results)
+}
+
+func (h *accessLogHandler) OnRequest() error {
+	return h.OnRequestContext(context.Background())
+}
+
+func (h *accessLogHandler) OnRequestContext(ctx context.Context) error {
+	if AttemptFromContext(ctx) <= 1 || h.entry == nil {
+		i := h.cursor.advance()
+		h.entry = h.log.Entries[i%uint64(len(h.log.Entries))]
+	}
+	entry := h.entry
+	step := &HTTPStep{Method: entry.Method, URL: entry.URL, Header: entry.Header, Body: entry.Body}
+	if !strings.Contains(entry.URL, "://") {
+		host := entry.Host
+		if host == "" {
+			if h.target == nil {
+				return errors.New("kite: access log entry without host, Request.Url required")
+			}
+			host = h.target.Host
+		}
+		step.URL = "http://" + host + entry.URL
+	}
+	return h.do(ctx, step)
+}
@@ -0,0 +1,118 @@
+package kite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadAccessLog(t *testing.T) {
+	ts := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	cases := []struct {
+		name    string
+		opt     AccessLogOptions
+		input   string
+		want    []*AccessLogEntry // nil表示读取出错
+		skipped int
+	}{
+		{
+			name: "common and combined",
+			input: `10.0.0.1 - - [10/Oct/2026:13:55:37 +0000] "GET /b?id=2 HTTP/1.1" 200 12
+10.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "POST /a HTTP/1.1" 201 5 "http://ref/" "curl/7.0"
+not a log line
+10.0.0.1 - - [10/Oct/2026:13:55:38 +0000] "GET /c HTTP/1.1" 200 0 "-" "-"`,
+			want: []*AccessLogEntry{
+				{Time: ts("2026-10-10T13:55:36Z"), Method: "POST", URL: "/a", Header: http.Header{"Referer": {"http://ref/"}, "User-Agent": {"curl/7.0"}}},
+				{Time: ts("2026-10-10T13:55:37Z"), Method: "GET", URL: "/b?id=2", Header: http.Header{}},
+				{Time: ts("2026-10-10T13:55:38Z"), Method: "GET", URL: "/c", Header: http.Header{}},
+			},
+			skipped: 1,
+		},
+		{
+			name: "json nested fields",
+			opt: AccessLogOptions{Format: AccessLogJSON, Fields: AccessLogFields{
+				Time: "ts", TimeLayout: "unix_ms", Method: "req.method", URL: "req.uri", Body: "req.body",
+				Headers: map[string]string{"X-Trace": "trace"},
+			}},
+			input: `{"ts": 1760104537500, "req": {"method": "PUT", "uri": "/x", "body": "{}"}, "host": "api", "trace": "t1"}
+{"ts": "1760104537000", "req": {"method": "GET", "uri": "/y"}}
+{"ts": 1760104538000, "req": {"method": "GET"}}
+{broken`,
+			want: []*AccessLogEntry{
+				{Time: time.Unix(1760104537, 0), Method: "GET", URL: "/y", Header: http.Header{}},
+				{Time: time.Unix(1760104537, 5e8), Method: "PUT", URL: "/x", Host: "api", Header: http.Header{"X-Trace": {"t1"}}, Body: []byte("{}")},
+			},
+			skipped: 2,
+		},
+		{
+			name:  "no valid entry",
+			input: "garbage\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l, err := LoadAccessLog(strings.NewReader(c.input), &c.opt)
+			if c.want == nil {
+				if err == nil {
+					t.Errorf("got %d entries, want error", len(l.Entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if l.Skipped != c.skipped {
+				t.Errorf("skipped = %d, want %d", l.Skipped, c.skipped)
+			}
+			if len(l.Entries) != len(c.want) {
+				t.Fatalf("got %d entries, want %d", len(l.Entries), len(c.want))
+			}
+			for i, e := range l.Entries {
+				w := c.want[i]
+				if !e.Time.Equal(w.Time) || e.Method != w.Method || e.URL != w.URL || e.Host != w.Host ||
+					!reflect.DeepEqual(e.Header, w.Header) || string(e.Body) != string(w.Body) {
+					t.Errorf("entry %d = %+v, want %+v", i, e, w)
+				}
+			}
+		})
+	}
+}
+
+// 同一handler用于多次Run时每次都从第一条日志开始回放
+func TestAccessLogReplayPerRun(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	log := &AccessLog{Entries: []*AccessLogEntry{
+		{Method: "GET", URL: "/a"},
+		{Method: "GET", URL: "/b"},
+		{Method: "GET", URL: "/c"},
+	}}
+	handler := NewAccessLogHandler(&AccessLogReplayConfig{Log: log})
+	cfg := &Config{ConcurrencyNum: 1, ReqNumPerConcy: 2, ResultsBufferSize: 16}
+	for run := 1; run <= 2; run++ {
+		paths = nil
+		if _, err := quietServer().Run(cfg, &Request{Url: srv.URL}, handler); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if want := []string{"/a", "/b"}; !reflect.DeepEqual(paths, want) {
+			t.Errorf("run %d replayed %v, want %v", run, paths, want)
+		}
+	}
+}
@@ -15,3 +15,11 @@ func RegisterMsgType(mt MsgType, name string) {
 	usrMsgTypes[mt] = name
 	lock.Unlock()
 }
+
+// 注册消息类型mt下的错误码名称, 如RegisterErrCode(MSG_HTTP, 429, "rate_limited"), 优先于内置名称
+// 不同消息类型的同一错误码(如grpc状态码14与自定义协议的14)互不影响
+func RegisterErrCode(mt MsgType, code int, name string) {
+	lock.Lock()
+	usrErrCodes[errCodeKey{mt, code}] = name
+	lock.Unlock()
+}
@@ -0,0 +1,253 @@
+package kite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 开环压测的到达过程
+// Next返回offset(距开始的计划时间)之后下一次到达的间隔, ok为false表示到达结束
+type ArrivalProcess interface {
+	Next(offset time.Duration, r *rand.Rand) (gap time.Duration, ok bool)
+}
+
+// 带有回放位置等状态的到达过程, 每次运行开始时复制一份, 使同一Config可重复运行
+type statefulArrival interface {
+	newRun() ArrivalProcess
+}
+
+// 速率rate(次/秒)下的到达间隔, poisson为true时间隔服从指数分布
+func arrivalGap(rate float64, poisson bool, r *rand.Rand) time.Duration {
+	gap := 1 / rate
+	if poisson {
+		gap = r.ExpFloat64() / rate
+	}
+	return time.Duration(gap * float64(time.Second))
+}
+
+// 固定速率, 均匀间隔
+type ConstantArrival struct {
+	Rate float64 // 次/秒
+}
+
+func (a ConstantArrival) Next(offset time.Duration, r *rand.Rand) (time.Duration, bool) {
+	if a.Rate <= 0 {
+		return 0, false
+	}
+	return arrivalGap(a.Rate, false, r), true
+}
+
+// 泊松到达, 间隔服从均值为1/Rate的指数分布
+type PoissonArrival struct {
+	Rate float64 // 次/秒
+}
+
+func (a PoissonArrival) Next(offset time.Duration, r *rand.Rand) (time.Duration, bool) {
+	if a.Rate <= 0 {
+		return 0, false
+	}
+	return arrivalGap(a.Rate, true, r), true
+}
+
+// 突发: On时长内速率为OnRate, Off时长内速率为OffRate(0表示静默), 交替进行
+type OnOffArrival struct {
+	OnRate  float64
+	OffRate float64
+	On      time.Duration
+	Off     time.Duration
+	Poisson bool // 各阶段内是否为泊松到达
+}
+
+// 连续多少个阶段没有到达时结束, 避免速率过低时无限查找
+const onOffMaxPhases = 1000
+
+func (a OnOffArrival) Next(offset time.Duration, r *rand.Rand) (time.Duration, bool) {
+	cycle := a.On + a.Off
+	if cycle <= 0 || (a.OnRate <= 0 && a.OffRate <= 0) {
+		return 0, false
+	}
+	var skipped time.Duration
+	for i := 0; i < onOffMaxPhases; i++ {
+		pos := (offset + skipped) % cycle
+		rate, phaseEnd := a.OnRate, a.On
+		if pos >= a.On {
+			rate, phaseEnd = a.OffRate, cycle
+		}
+		if rate > 0 {
+			if i > 0 && !a.Poisson {
+				// 均匀到达在新阶段开始时立即到达
+				return skipped, true
+			}
+			if gap := arrivalGap(rate, a.Poisson, r); pos+gap < phaseEnd {
+				return skipped + gap, true
+			}
+		}
+		// 静默阶段或间隔越过阶段结束: 跳到下一阶段开始, 按该阶段的速率重新抽取(泊松过程无记忆)
+		skipped += phaseEnd - pos
+	}
+	return 0, false
+}
+
+// 正弦速率: Base+Amplitude*sin(2π*t/Period), 用于模拟日周期曲线
+type SineArrival struct {
+	Base      float64
+	Amplitude float64
+	Period    time.Duration
+	Poisson   bool
+}
+
+// 速率低于该值时按该值计算间隔, 避免间隔过大错过回升
+const minArrivalRate = 0.1
+
+func (a SineArrival) Next(offset time.Duration, r *rand.Rand) (time.Duration, bool) {
+	if a.Period <= 0 || a.Base+math.Abs(a.Amplitude) <= 0 {
+		return 0, false
+	}
+	rate := a.Base + a.Amplitude*math.Sin(2*math.Pi*float64(offset)/float64(a.Period))
+	if rate < minArrivalRate {
+		rate = minArrivalRate
+	}
+	return arrivalGap(rate, a.Poisson, r), true
+}
+
+// 回放到达时间序列, 回放位置属于单次运行, 同一实例可用于多次Run
+type TraceArrival struct {
+	Offsets []time.Duration // 升序的到达时间(距开始)
+	Speed   float64         // 回放速度倍数, 默认1
+	next    int
+}
+
+func (a *TraceArrival) newRun() ArrivalProcess {
+	return &TraceArrival{Offsets: a.Offsets, Speed: a.Speed}
+}
+
+func (a *TraceArrival) Next(offset time.Duration, r *rand.Rand) (time.Duration, bool) {
+	if a.next >= len(a.Offsets) {
+		return 0, false
+	}
+	speed := a.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	at := time.Duration(float64(a.Offsets[a.next]) / speed)
+	a.next++
+	if at < offset {
+		return 0, true
+	}
+	return at - offset, true
+}
+
+// 读取到达时间序列, 每行一个距开始的秒数(可为小数)或时长(如150ms), 忽略空行及#开头的行
+func LoadArrivalTrace(rd io.Reader) (*TraceArrival, error) {
+	trace := &TraceArrival{}
+	scanner := bufio.NewScanner(rd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		d, err := time.ParseDuration(line)
+		if err != nil {
+			sec, perr := strconv.ParseFloat(line, 64)
+			if perr != nil {
+				return nil, fmt.Errorf("trace line %d: invalid offset %q", n, line)
+			}
+			d = time.Duration(sec * float64(time.Second))
+		}
+		trace.Offsets = append(trace.Offsets, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(trace.Offsets, func(i, j int) bool { return trace.Offsets[i] < trace.Offsets[j] })
+	return trace, nil
+}
+
+// 解析到达过程描述, 格式:
+//
+//	const:100
+//	poisson:100
+//	onoff:500,0,1s,4s[,poisson]
+//	sine:100,50,60s[,poisson]
+func ParseArrival(spec string) (ArrivalProcess, error) {
+	kind, args := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, args = spec[:i], spec[i+1:]
+	}
+	params := strings.Split(args, ",")
+	for i := range params {
+		params[i] = strings.TrimSpace(params[i])
+	}
+	poisson := params[len(params)-1] == "poisson"
+	if poisson {
+		params = params[:len(params)-1]
+	}
+	floats := func(n int) ([]float64, error) {
+		if len(params) < n {
+			return nil, fmt.Errorf("arrival %q needs %d params", spec, n)
+		}
+		res := make([]float64, n)
+		for i := 0; i < n; i++ {
+			v, err := strconv.ParseFloat(params[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("arrival %q: %v", spec, err)
+			}
+			res[i] = v
+		}
+		return res, nil
+	}
+	durations := func(from, n int) ([]time.Duration, error) {
+		if len(params) < from+n {
+			return nil, fmt.Errorf("arrival %q needs %d params", spec, from+n)
+		}
+		res := make([]time.Duration, n)
+		for i := 0; i < n; i++ {
+			d, err := time.ParseDuration(params[from+i])
+			if err != nil {
+				return nil, fmt.Errorf("arrival %q: %v", spec, err)
+			}
+			res[i] = d
+		}
+		return res, nil
+	}
+	switch kind {
+	case "const", "poisson":
+		fs, err := floats(1)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "poisson" {
+			return PoissonArrival{Rate: fs[0]}, nil
+		}
+		return ConstantArrival{Rate: fs[0]}, nil
+	case "onoff":
+		fs, err := floats(2)
+		if err != nil {
+			return nil, err
+		}
+		ds, err := durations(2, 2)
+		if err != nil {
+			return nil, err
+		}
+		return OnOffArrival{OnRate: fs[0], OffRate: fs[1], On: ds[0], Off: ds[1], Poisson: poisson}, nil
+	case "sine":
+		fs, err := floats(2)
+		if err != nil {
+			return nil, err
+		}
+		ds, err := durations(2, 1)
+		if err != nil {
+			return nil, err
+		}
+		return SineArrival{Base: fs[0], Amplitude: fs[1], Period: ds[0], Poisson: poisson}, nil
+	default:
+		return nil, fmt.Errorf("unknown arrival %q", spec)
+	}
+}
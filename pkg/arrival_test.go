@@ -0,0 +1,166 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseArrival(t *testing.T) {
+	cases := []struct {
+		spec string
+		want ArrivalProcess // nil表示解析出错
+	}{
+		{"const:100", ConstantArrival{Rate: 100}},
+		{"poisson: 50", PoissonArrival{Rate: 50}},
+		{"onoff:500,0,1s,4s", OnOffArrival{OnRate: 500, On: time.Second, Off: 4 * time.Second}},
+		{"onoff:500,10,1s,4s,poisson", OnOffArrival{OnRate: 500, OffRate: 10, On: time.Second, Off: 4 * time.Second, Poisson: true}},
+		{"sine:100,50,60s", SineArrival{Base: 100, Amplitude: 50, Period: time.Minute}},
+		{"sine:100,50,60s,poisson", SineArrival{Base: 100, Amplitude: 50, Period: time.Minute, Poisson: true}},
+		{"const", nil},
+		{"const:abc", nil},
+		{"onoff:500,0,1s", nil},
+		{"onoff:500,0,1s,x", nil},
+		{"burst:100", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			got, err := ParseArrival(c.spec)
+			if c.want == nil {
+				if err == nil {
+					t.Errorf("got %+v, want error", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v (err %v), want %+v", got, err, c.want)
+			}
+		})
+	}
+}
+
+// 依次调用Next得到的到达时间
+func arrivalOffsets(a ArrivalProcess, n int) []time.Duration {
+	r := rand.New(rand.NewSource(1))
+	var offset time.Duration
+	var res []time.Duration
+	for i := 0; i < n; i++ {
+		gap, ok := a.Next(offset, r)
+		if !ok {
+			break
+		}
+		offset += gap
+		res = append(res, offset)
+	}
+	return res
+}
+
+func TestArrivalOffsets(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		name    string
+		arrival ArrivalProcess
+		n       int
+		want    []time.Duration
+	}{
+		{"constant", ConstantArrival{Rate: 10}, 3, []time.Duration{100 * ms, 200 * ms, 300 * ms}},
+		{"constant zero rate", ConstantArrival{}, 3, nil},
+		// 越过On阶段结束的到达顺延到下一个On阶段开始
+		{"onoff clipped", OnOffArrival{OnRate: 10, On: 250 * ms, Off: 750 * ms}, 5,
+			[]time.Duration{100 * ms, 200 * ms, 1000 * ms, 1100 * ms, 1200 * ms}},
+		{"onoff off rate", OnOffArrival{OnRate: 10, OffRate: 2, On: 250 * ms, Off: 750 * ms}, 4,
+			[]time.Duration{100 * ms, 200 * ms, 250 * ms, 750 * ms}},
+		{"onoff silent", OnOffArrival{On: time.Second, Off: time.Second}, 3, nil},
+		{"trace", &TraceArrival{Offsets: []time.Duration{0, 50 * ms, 50 * ms, 200 * ms}, Speed: 2}, 10,
+			[]time.Duration{0, 25 * ms, 25 * ms, 100 * ms}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := arrivalOffsets(c.arrival, c.n); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("offsets = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadArrivalTrace(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  []time.Duration // nil表示读取出错
+	}{
+		{"seconds and durations", "# trace\n0.5\n\n150ms\n1\n", []time.Duration{150 * time.Millisecond, 500 * time.Millisecond, time.Second}},
+		{"invalid line", "1\nsoon\n", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			trace, err := LoadArrivalTrace(strings.NewReader(c.input))
+			if c.want == nil {
+				if err == nil {
+					t.Errorf("got %v, want error", trace.Offsets)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(trace.Offsets, c.want) {
+				t.Errorf("offsets = %v (err %v), want %v", trace, err, c.want)
+			}
+		})
+	}
+}
+
+// 同一TraceArrival用于多次Run时每次都从头回放
+func TestTraceArrivalReuse(t *testing.T) {
+	trace := &TraceArrival{Offsets: []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond}}
+	cfg := &Config{ConcurrencyNum: 1, ReqNumPerConcy: 10, ResultsBufferSize: 16, Arrival: trace}
+	for run := 1; run <= 2; run++ {
+		var n int32
+		_, err := quietServer().Run(cfg, &Request{}, func() ReqHandler {
+			return &funcHandler{onRequest: func(ctx context.Context, results chan<- *Response) error {
+				atomic.AddInt32(&n, 1)
+				return nil
+			}}
+		})
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if n != 3 {
+			t.Errorf("run %d: %d requests, want 3", run, n)
+		}
+	}
+}
+
+// 终止后不再执行队列中剩余的计划请求
+func TestOpenLoopAbort(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	cfg := &Config{ConcurrencyNum: 2, ReqNumPerConcy: 5000, ResultsBufferSize: 16, Arrival: ConstantArrival{Rate: 5000}}
+	s := quietServer()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.Abort()
+	}()
+	var n int32
+	start := time.Now()
+	_, err := s.Run(cfg, &Request{}, func() ReqHandler {
+		return &funcHandler{onRequest: func(ctx context.Context, results chan<- *Response) error {
+			atomic.AddInt32(&n, 1)
+			time.Sleep(latency)
+			return nil
+		}}
+	})
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrRunAborted) {
+		t.Errorf("err = %v, want ErrRunAborted", err)
+	}
+	// 每个worker在终止时至多再完成一个进行中的请求
+	if elapsed > 2*time.Second {
+		t.Errorf("run took %v after abort, want prompt return", elapsed)
+	}
+	if max := int32(elapsed/latency+1) * int32(cfg.ConcurrencyNum); n > max {
+		t.Errorf("%d requests executed, want at most %d", n, max)
+	}
+}
@@ -0,0 +1,442 @@
+package kite
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// 认证方式, 为请求提供Authorization的值
+// 获取token(如请求token端点, 签名)的耗时以消息类型auth单独上报到results, 不计入接口延迟
+// ctx中的RunState用于区分虚拟用户
+type AuthProvider interface {
+	Authorization(ctx context.Context, results chan<- *Response) (string, error)
+}
+
+// 静态bearer token
+type BearerToken string
+
+func (t BearerToken) Authorization(ctx context.Context, results chan<- *Response) (string, error) {
+	return "Bearer " + string(t), nil
+}
+
+// OAuth2 client credentials授权, 所有worker共享缓存的token, 过期前EarlyRefresh刷新
+// 同一时刻只有一个worker请求token端点, 旧token未过期时其余worker继续使用, 否则等待刷新结果
+// 获取失败后按退避时间(1秒起, 最长30秒)不再请求, 期间旧token未过期时继续使用, 否则返回上次的错误
+type OAuth2ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	EarlyRefresh time.Duration // 提前刷新的时长, 默认30秒
+	Client       *http.Client  // 请求token端点的客户端, 默认http.DefaultClient
+
+	mu       sync.Mutex
+	token    string
+	refresh  time.Time
+	expires  time.Time
+	fetching chan struct{} // 正在刷新时非nil, 刷新结束时关闭
+	err      error         // 上次获取失败的错误
+	retryAt  time.Time     // 获取失败后的下次重试时间
+	backoff  time.Duration
+}
+
+const (
+	oauthRetryMin = time.Second
+	oauthRetryMax = 30 * time.Second
+)
+
+func (o *OAuth2ClientCredentials) Authorization(ctx context.Context, results chan<- *Response) (string, error) {
+	for {
+		o.mu.Lock()
+		now := time.Now()
+		token := o.token
+		if token != "" && now.Before(o.refresh) {
+			o.mu.Unlock()
+			return "Bearer " + token, nil
+		}
+		valid := token != "" && now.Before(o.expires)
+		if o.fetching == nil {
+			if now.Before(o.retryAt) {
+				err := o.err
+				o.mu.Unlock()
+				if valid {
+					return "Bearer " + token, nil
+				}
+				return "", err
+			}
+			ch := make(chan struct{})
+			o.fetching = ch
+			o.mu.Unlock()
+			return o.refreshToken(ctx, results, ch)
+		}
+		ch := o.fetching
+		o.mu.Unlock()
+		if valid {
+			return "Bearer " + token, nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// 不持锁请求token端点, 结束后更新缓存并唤醒等待的worker
+func (o *OAuth2ClientCredentials) refreshToken(ctx context.Context, results chan<- *Response, ch chan struct{}) (string, error) {
+	startTime := time.Now()
+	token, ttl, code, err := o.fetch(ctx)
+	result := &Response{
+		MsgType:   MSG_AUTH,
+		Method:    "[TOKEN]" + o.TokenURL,
+		StartTime: startTime,
+		UseTime:   uint64(time.Since(startTime)),
+		IsSucceed: err == nil,
+		ErrCode:   code,
+	}
+	if err != nil {
+		result.ErrMsg = err.Error()
+	}
+	fillRunState(ctx, result)
+	SendResponse(results, result)
+
+	o.mu.Lock()
+	defer func() {
+		o.fetching = nil
+		close(ch)
+		o.mu.Unlock()
+	}()
+	if err != nil {
+		// 本次请求被取消(如超时)时不退避, 由下一个worker重新获取
+		if ctx.Err() == nil {
+			o.backoff *= 2
+			if o.backoff < oauthRetryMin {
+				o.backoff = oauthRetryMin
+			}
+			if o.backoff > oauthRetryMax {
+				o.backoff = oauthRetryMax
+			}
+			o.err, o.retryAt = err, time.Now().Add(o.backoff)
+		}
+		// 提前刷新失败时旧token仍可使用, 过期后才返回错误
+		if o.token != "" && time.Now().Before(o.expires) {
+			return "Bearer " + o.token, nil
+		}
+		return "", err
+	}
+	// 有效期较短时最多提前一半有效期刷新
+	early := o.EarlyRefresh
+	if early <= 0 {
+		early = 30 * time.Second
+	}
+	if early > ttl/2 {
+		early = ttl / 2
+	}
+	o.token, o.refresh, o.expires = token, startTime.Add(ttl-early), startTime.Add(ttl)
+	o.err, o.retryAt, o.backoff = nil, time.Time{}, 0
+	return "Bearer " + token, nil
+}
+
+// 返回token, 有效期, 错误码(http状态码或ERR_CODE_REQUEST)
+func (o *OAuth2ClientCredentials) fetch(ctx context.Context) (string, time.Duration, int, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, ERR_CODE_REQUEST, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, ERR_CODE_REQUEST, err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", 0, rsp.StatusCode, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", 0, rsp.StatusCode, fmt.Errorf("token endpoint: %s", rsp.Status)
+	}
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil || tr.AccessToken == "" {
+		return "", 0, rsp.StatusCode, fmt.Errorf("token endpoint: invalid response %.64q", body)
+	}
+	ttl := time.Duration(tr.ExpiresIn) * time.Second
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return tr.AccessToken, ttl, rsp.StatusCode, nil
+}
+
+// 为每个虚拟用户提供一条数据, 如账号, 租户
+type Feeder interface {
+	Record(worker int) map[string]string
+}
+
+// csv数据, 第一行为列名, 第n个worker使用第n%行数条记录
+type CSVFeeder struct {
+	Records []map[string]string
+}
+
+func (f *CSVFeeder) Record(worker int) map[string]string {
+	if len(f.Records) == 0 {
+		return nil
+	}
+	return f.Records[worker%len(f.Records)]
+}
+
+func LoadCSVFeeder(r io.Reader) (*CSVFeeder, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, errors.New("feeder: no record")
+	}
+	f := &CSVFeeder{}
+	for _, row := range rows[1:] {
+		rec := make(map[string]string, len(rows[0]))
+		for i, name := range rows[0] {
+			if i < len(row) {
+				rec[name] = row[i]
+			}
+		}
+		f.Records = append(f.Records, rec)
+	}
+	return f, nil
+}
+
+// 本地签名的JWT, 每个虚拟用户一个token, 过期前重新签名
+// 配置Feeder时ctx中须有RunState(OnRequestContext的ctx), 否则返回错误
+// 支持HS256(Key为密钥)及RS256(RSAKey为私钥)
+type JWTSigner struct {
+	Algorithm string                 // HS256或RS256, 默认HS256
+	Key       []byte                 // HS256密钥
+	RSAKey    *rsa.PrivateKey        // RS256私钥
+	KeyID     string                 // 非空时写入header的kid
+	Claims    map[string]interface{} // 所有用户共同的claims
+	Feeder    Feeder                 // 按worker取该用户的claims, 覆盖Claims中的同名项
+	TTL       time.Duration          // 有效期, 写入exp, 默认1小时
+
+	mu     sync.Mutex
+	tokens map[int]*jwtToken
+}
+
+var errJWTNoRunState = errors.New("jwt: Feeder needs the RunState in ctx to pick the user, use the ctx of OnRequestContext")
+
+type jwtToken struct {
+	token   string
+	expires time.Time
+}
+
+func (j *JWTSigner) Authorization(ctx context.Context, results chan<- *Response) (string, error) {
+	worker := 0
+	if rs := RunStateFromContext(ctx); rs != nil {
+		worker = rs.Worker
+	} else if j.Feeder != nil {
+		// 无法区分虚拟用户, 避免所有请求使用同一用户的数据
+		return "", errJWTNoRunState
+	}
+	ttl := j.TTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	j.mu.Lock()
+	t, ok := j.tokens[worker]
+	j.mu.Unlock()
+	if ok && time.Now().Add(ttl/10).Before(t.expires) {
+		return "Bearer " + t.token, nil
+	}
+	// 各worker只签名自己的token, 签名时不持锁
+	startTime := time.Now()
+	token, err := j.sign(worker, startTime, ttl)
+	result := &Response{
+		MsgType:   MSG_AUTH,
+		Method:    "[JWT]" + j.algorithm(),
+		StartTime: startTime,
+		UseTime:   uint64(time.Since(startTime)),
+		IsSucceed: err == nil,
+	}
+	if err != nil {
+		result.ErrCode = ERR_CODE_REQUEST
+		result.ErrMsg = err.Error()
+	}
+	fillRunState(ctx, result)
+	SendResponse(results, result)
+	if err != nil {
+		return "", err
+	}
+	j.mu.Lock()
+	if j.tokens == nil {
+		j.tokens = make(map[int]*jwtToken)
+	}
+	j.tokens[worker] = &jwtToken{token: token, expires: startTime.Add(ttl)}
+	j.mu.Unlock()
+	return "Bearer " + token, nil
+}
+
+func (j *JWTSigner) algorithm() string {
+	if j.Algorithm == "" {
+		return "HS256"
+	}
+	return j.Algorithm
+}
+
+func (j *JWTSigner) sign(worker int, now time.Time, ttl time.Duration) (string, error) {
+	header := map[string]string{"alg": j.algorithm(), "typ": "JWT"}
+	if j.KeyID != "" {
+		header["kid"] = j.KeyID
+	}
+	claims := map[string]interface{}{
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	for k, v := range j.Claims {
+		claims[k] = v
+	}
+	if j.Feeder != nil {
+		for k, v := range j.Feeder.Record(worker) {
+			claims[k] = v
+		}
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	var sig []byte
+	switch j.algorithm() {
+	case "HS256":
+		mac := hmac.New(sha256.New, j.Key)
+		mac.Write([]byte(signing))
+		sig = mac.Sum(nil)
+	case "RS256":
+		if j.RSAKey == nil {
+			return "", errors.New("jwt: RS256 needs RSAKey")
+		}
+		digest := sha256.Sum256([]byte(signing))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, j.RSAKey, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("jwt: unsupported algorithm %s", j.Algorithm)
+	}
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+// 解析PEM格式的RSA私钥, 支持PKCS#1及PKCS#8
+func ParseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("rsa key: no PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("rsa key: not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+// 客户端证书(mTLS)及服务端证书校验配置
+type ClientTLS struct {
+	CertFile           string // 客户端证书, 与KeyFile同时为空时不提供证书
+	KeyFile            string
+	CAFile             string // 校验服务端证书的CA, 为空时使用系统CA
+	ServerName         string
+	InsecureSkipVerify bool // 不校验服务端证书
+}
+
+func (c *ClientTLS) Config() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("tls: no certificate in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// 为请求附加Authorization头, 需包在HTTPClientInterceptor外层, token获取耗时不计入接口延迟
+func HTTPAuthTransport(auth AuthProvider, results chan<- *Response, rt http.RoundTripper) http.RoundTripper {
+	return HTTPRoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		token, err := auth.Authorization(req.Context(), results)
+		if err != nil {
+			return nil, err
+		}
+		// RoundTripper不应修改原请求
+		r := req.Clone(req.Context())
+		r.Header.Set("Authorization", token)
+		return rt.RoundTrip(r)
+	})
+}
+
+// 为grpc请求附加authorization元数据, 需在GRPCClientInterceptor之前(外层), 如:
+//
+//	grpc.WithChainUnaryInterceptor(kite.GRPCAuthInterceptor(auth, results), kite.GRPCClientInterceptor(results, nil))
+func GRPCAuthInterceptor(auth AuthProvider, results chan<- *Response) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		token, err := auth.Authorization(ctx, results)
+		if err != nil {
+			return err
+		}
+		return invoker(metadata.AppendToOutgoingContext(ctx, "authorization", token), method, req, reply, cc, opts...)
+	}
+}
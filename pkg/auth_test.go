@@ -0,0 +1,47 @@
+package kite
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 提前刷新失败时旧token未过期则继续使用, 过期后才返回错误
+func TestOAuth2RefreshFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name      string
+		expiresIn time.Duration // 旧token距过期的时长
+		want      string
+		wantErr   bool
+	}{
+		{"cached token valid", time.Minute, "Bearer old", false},
+		{"cached token expired", -time.Second, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Now()
+			o := &OAuth2ClientCredentials{TokenURL: srv.URL, token: "old", refresh: now.Add(-time.Second), expires: now.Add(c.expiresIn)}
+			results := make(chan *Response, 4)
+			for i := 0; i < 2; i++ {
+				// 第二次调用处于退避期, 不再请求token端点
+				got, err := o.Authorization(context.Background(), results)
+				if got != c.want || (err != nil) != c.wantErr {
+					t.Errorf("call %d = %q, %v, want %q (error %v)", i+1, got, err, c.want, c.wantErr)
+				}
+			}
+			if len(results) != 1 {
+				t.Fatalf("%d token results, want 1", len(results))
+			}
+			if result := <-results; result.MsgType != MSG_AUTH || result.IsSucceed || result.ErrCode != http.StatusServiceUnavailable {
+				t.Errorf("token result = %+v, want failed auth with 503", result)
+			}
+		})
+	}
+}
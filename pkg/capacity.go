@@ -0,0 +1,293 @@
+package kite
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 容量搜索的调节维度
+type SearchDimension int
+
+const (
+	SearchConcurrency SearchDimension = iota // 调节闭环并发数
+	SearchRate                               // 调节开环到达速率(次/秒)
+)
+
+// 容量搜索策略
+type SearchMode int
+
+const (
+	SearchBinary SearchMode = iota // 在[Min, Max]内二分查找
+	SearchAIMD                     // 满足SLO时加性增加Step, 不满足时乘以Backoff
+)
+
+// 服务等级目标, 为0的项不检查
+type SLO struct {
+	Percentile   float64 // 检查的延迟百分位, 默认99
+	LatencyMS    float64 // 该百分位延迟上限
+	MaxErrorRate float64 // 错误率上限, 0~1
+}
+
+type CapacityConfig struct {
+	Base      *Config // 各阶段共用的配置, ConcurrencyNum(SearchConcurrency时), Arrival及DurationSec由搜索设置
+	Dimension SearchDimension
+	Mode      SearchMode
+	Min       float64 // 搜索下限(并发数或速率)
+	Max       float64 // 搜索上限
+	Tolerance float64 // 二分查找的终止区间宽度, 默认SearchConcurrency为1, SearchRate为Min的5%
+	Step      float64 // AIMD的加性增量, 默认为(Max-Min)/10
+	Backoff   float64 // AIMD的乘性减少因子, 默认0.5
+	StageSec  int     // 每阶段时长, 默认10秒
+	MaxStages int     // 最大阶段数, 默认20
+	SLO       SLO
+	// SearchRate时按速率生成到达过程, 默认PoissonArrival
+	NewArrival func(rate float64) ArrivalProcess
+	// 参与SLO判断的统计项, 默认除handler以外的所有Header
+	Filter func(h Header) bool
+}
+
+func (cfg *CapacityConfig) setDefaults() {
+	if cfg.Tolerance <= 0 {
+		cfg.Tolerance = 1
+		if cfg.Dimension == SearchRate {
+			cfg.Tolerance = math.Max(cfg.Min*0.05, 1)
+		}
+	}
+	if cfg.Step <= 0 {
+		cfg.Step = math.Max((cfg.Max-cfg.Min)/10, 1)
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.5
+	}
+	if cfg.StageSec <= 0 {
+		cfg.StageSec = 10
+	}
+	if cfg.MaxStages <= 0 {
+		cfg.MaxStages = 20
+	}
+	if cfg.SLO.Percentile <= 0 {
+		cfg.SLO.Percentile = 99
+	}
+	if cfg.NewArrival == nil {
+		cfg.NewArrival = func(rate float64) ArrivalProcess { return PoissonArrival{Rate: rate} }
+	}
+	if cfg.Filter == nil {
+		cfg.Filter = func(h Header) bool { return h.MsgType != MSG_HANDLER && h.MsgType != MSG_AUTH }
+	}
+}
+
+// 单个阶段的结果
+type CapacityPoint struct {
+	Stage        int
+	Load         float64 // 并发数或目标速率
+	QPS          float64 // 稳定区间内的成功qps
+	AvgLatencyMS float64
+	PctLatencyMS float64 // 稳定区间内全部结果的SLO.Percentile延迟
+	ErrorRate    float64
+	Passed       bool // 是否满足SLO
+}
+
+type CapacityResult struct {
+	Dimension SearchDimension
+	SLO       SLO
+	Stages    []CapacityPoint // 按执行顺序
+	Knee      *CapacityPoint  // 满足SLO的最大吞吐阶段, 均不满足时为nil
+}
+
+// 按负载排序的容量曲线, 同一负载多次执行时保留最后一次
+func (r *CapacityResult) Curve() []CapacityPoint {
+	byLoad := make(map[float64]CapacityPoint)
+	for _, p := range r.Stages {
+		byLoad[p.Load] = p
+	}
+	curve := make([]CapacityPoint, 0, len(byLoad))
+	for _, p := range byLoad {
+		curve = append(curve, p)
+	}
+	sort.Slice(curve, func(i, j int) bool { return curve[i].Load < curve[j].Load })
+	return curve
+}
+
+func (r *CapacityResult) Output(logfn LogFunc) {
+	load := "  并发数"
+	if r.Dimension == SearchRate {
+		load = " 目标qps"
+	}
+	logfn("Capacity curve (SLO: p%v<%.2fms 错误率<%.2f%%):\n", r.SLO.Percentile, r.SLO.LatencyMS, r.SLO.MaxErrorRate*100)
+	logfn("%s│       qps│  平均耗时│百分位耗时│  错误率│ SLO\n", load)
+	for _, p := range r.Curve() {
+		mark := "FAIL"
+		if p.Passed {
+			mark = "PASS"
+		}
+		if r.Knee != nil && p.Stage == r.Knee.Stage {
+			mark += " <= knee"
+		}
+		logfn("%8.1f│%10.2f│%8.2fms│%8.2fms│%7.2f%%│ %s\n", p.Load, p.QPS, p.AvgLatencyMS, p.PctLatencyMS, p.ErrorRate*100, mark)
+	}
+	if r.Knee == nil {
+		logfn("Knee: 所有阶段均不满足SLO\n")
+		return
+	}
+	logfn("Knee: %s %.1f, qps %.2f, p%v %.2fms, 错误率 %.2f%%\n",
+		strings.TrimSpace(load), r.Knee.Load, r.Knee.QPS, r.SLO.Percentile, r.Knee.PctLatencyMS, r.Knee.ErrorRate*100)
+}
+
+// 阶段内的采样间隔, 对应StatFreqSec为0时Statistician的默认值
+const stageInterval = time.Second
+
+// 由阶段报告的时间序列计算稳定区间的指标, 第一个采样区间视为爬坡不计入
+func (cfg *CapacityConfig) evaluate(stage int, load float64, reports []*Report) CapacityPoint {
+	p := CapacityPoint{Stage: stage, Load: load}
+	type interval struct {
+		success, failure uint64
+		latencySum       float64
+		latencies        []float64
+	}
+	var intervals []*interval
+	for _, r := range reports {
+		if !cfg.Filter(r.Header) {
+			continue
+		}
+		for i, tp := range r.Timeline {
+			for len(intervals) <= i {
+				intervals = append(intervals, &interval{})
+			}
+			iv := intervals[i]
+			iv.success += tp.SuccessNum
+			iv.failure += tp.FailureNum
+			iv.latencySum += tp.AvgLatencyMS * float64(tp.SuccessNum+tp.FailureNum)
+			iv.latencies = append(iv.latencies, tp.latencies...)
+		}
+	}
+	// 最后一个采样区间不完整, 同样不计入
+	if len(intervals) > 2 {
+		intervals = intervals[1 : len(intervals)-1]
+	}
+	var success, failure uint64
+	var latencySum float64
+	var latencies []float64
+	sec := float64(len(intervals)) * stageInterval.Seconds()
+	for _, iv := range intervals {
+		success += iv.success
+		failure += iv.failure
+		latencySum += iv.latencySum
+		latencies = append(latencies, iv.latencies...)
+	}
+	sort.Float64s(latencies)
+	p.PctLatencyMS = percentileOf(latencies, cfg.SLO.Percentile)
+	if sec > 0 {
+		p.QPS = float64(success) / sec
+	}
+	if total := success + failure; total > 0 {
+		p.AvgLatencyMS = latencySum / float64(total)
+		p.ErrorRate = float64(failure) / float64(total)
+	}
+	p.Passed = (cfg.SLO.LatencyMS <= 0 || p.PctLatencyMS <= cfg.SLO.LatencyMS) &&
+		(cfg.SLO.MaxErrorRate <= 0 || p.ErrorRate <= cfg.SLO.MaxErrorRate) && success > 0
+	return p
+}
+
+// 以load执行一个阶段, 阶段内的统计表不输出
+func (s *Server) runStage(cfg *CapacityConfig, load float64, req *Request, newHandler NewReqHandlerFunc) ([]*Report, error) {
+	stage := *cfg.Base
+	stage.DurationSec = cfg.StageSec
+	stage.ReqNumPerConcy = 0
+	stage.HTMLReportPath = ""
+	stage.Dashboard = false
+	stage.StatFreqSec = 0
+	if cfg.Dimension == SearchRate {
+		stage.Arrival = cfg.NewArrival(load)
+	} else {
+		stage.ConcurrencyNum = int(load)
+		stage.Arrival = nil
+	}
+	return s.run(&stage, req, newHandler, true)
+}
+
+// 自动搜索满足SLO的最大吞吐: 以较短的阶段反复执行Run, 按Mode调节并发数或速率
+// 中止(Server.Abort)时返回已完成阶段的结果及ErrRunAborted
+func (s *Server) SearchCapacity(cfg *CapacityConfig, req *Request, newHandler NewReqHandlerFunc) (*CapacityResult, error) {
+	if cfg.Base == nil || cfg.Max < cfg.Min || cfg.Min <= 0 {
+		return nil, errors.New("kite: invalid capacity search range")
+	}
+	// 默认值只作用于本次搜索, 不修改调用方的配置
+	c := *cfg
+	c.setDefaults()
+	cfg = &c
+	result := &CapacityResult{Dimension: cfg.Dimension, SLO: cfg.SLO}
+	round := func(load float64) float64 {
+		if cfg.Dimension == SearchConcurrency {
+			return math.Max(math.Round(load), 1)
+		}
+		return load
+	}
+	run := func(load float64) (bool, error) {
+		reports, err := s.runStage(cfg, load, req, newHandler)
+		if err != nil && (errors.Is(err, ErrRunAborted) || len(reports) == 0) {
+			return false, err
+		}
+		p := cfg.evaluate(len(result.Stages)+1, load, reports)
+		result.Stages = append(result.Stages, p)
+		if p.Passed && (result.Knee == nil || p.QPS > result.Knee.QPS) {
+			knee := p
+			result.Knee = &knee
+		}
+		s.logfn("[Stage:%d] load %.1f qps %.2f p%v %.2fms 错误率 %.2f%% passed=%v\n",
+			p.Stage, p.Load, p.QPS, cfg.SLO.Percentile, p.PctLatencyMS, p.ErrorRate*100, p.Passed)
+		return p.Passed, nil
+	}
+
+	var err error
+	switch cfg.Mode {
+	case SearchAIMD:
+		load := round(cfg.Min)
+		for len(result.Stages) < cfg.MaxStages {
+			var passed bool
+			if passed, err = run(load); err != nil {
+				break
+			}
+			if passed {
+				if load >= cfg.Max {
+					break
+				}
+				load = round(math.Min(load+cfg.Step, cfg.Max))
+			} else {
+				// 下限也不满足SLO时结束
+				if load <= round(cfg.Min) {
+					break
+				}
+				load = round(math.Max(load*cfg.Backoff, cfg.Min))
+			}
+		}
+	default:
+		lo, hi := round(cfg.Min), round(cfg.Max)
+		var passed bool
+		if passed, err = run(lo); err != nil || !passed {
+			break
+		}
+		if passed, err = run(hi); err != nil || passed {
+			break
+		}
+		// 不变式: lo满足SLO, hi不满足
+		for hi-lo > cfg.Tolerance && len(result.Stages) < cfg.MaxStages {
+			mid := round((lo + hi) / 2)
+			if mid <= lo || mid >= hi {
+				break
+			}
+			if passed, err = run(mid); err != nil {
+				break
+			}
+			if passed {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+	}
+	result.Output(s.logfn)
+	return result, err
+}
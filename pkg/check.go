@@ -0,0 +1,436 @@
+package kite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/status"
+)
+
+// 检查的输入
+type CheckInput struct {
+	StatusCode int           // http状态码或grpc状态码
+	Header     http.Header   // http响应头, grpc时为nil
+	Body       []byte        // http响应体, grpc时为nil
+	Size       int           // 响应大小
+	Message    proto.Message // grpc响应消息, http时为nil
+
+	parsed    bool
+	jsonValue interface{}
+	jsonErr   error
+}
+
+// 响应体(grpc时为响应消息)按json解析的结果, 多个检查共用
+func (in *CheckInput) json() (interface{}, error) {
+	if in.parsed {
+		return in.jsonValue, in.jsonErr
+	}
+	in.parsed = true
+	body := in.Body
+	if in.Message != nil {
+		m := jsonpb.Marshaler{OrigName: true, EmitDefaults: true}
+		s, err := m.MarshalToString(in.Message)
+		if err != nil {
+			in.jsonErr = err
+			return nil, err
+		}
+		body = []byte(s)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	in.jsonErr = dec.Decode(&in.jsonValue)
+	return in.jsonValue, in.jsonErr
+}
+
+// 对响应的声明式检查, Verify返回nil表示通过
+type Check interface {
+	Name() string
+	Verify(in *CheckInput) error
+}
+
+// 状态码在集合中
+type StatusIn []int
+
+func (c StatusIn) Name() string {
+	return fmt.Sprintf("status in %v", []int(c))
+}
+
+func (c StatusIn) Verify(in *CheckInput) error {
+	for _, code := range c {
+		if in.StatusCode == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("status %d", in.StatusCode)
+}
+
+// 响应体包含指定内容
+type BodyContains string
+
+func (c BodyContains) Name() string {
+	return fmt.Sprintf("body contains %q", string(c))
+}
+
+func (c BodyContains) Verify(in *CheckInput) error {
+	if !bytes.Contains(in.Body, []byte(c)) {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// 响应体匹配正则
+type BodyMatches struct {
+	Pattern *regexp.Regexp
+}
+
+func (c BodyMatches) Name() string {
+	return fmt.Sprintf("body matches %q", c.Pattern.String())
+}
+
+func (c BodyMatches) Verify(in *CheckInput) error {
+	if !c.Pattern.Match(in.Body) {
+		return errors.New("not matched")
+	}
+	return nil
+}
+
+// 响应头存在
+type HeaderPresent string
+
+func (c HeaderPresent) Name() string {
+	return fmt.Sprintf("header %s present", string(c))
+}
+
+func (c HeaderPresent) Verify(in *CheckInput) error {
+	if _, ok := in.Header[http.CanonicalHeaderKey(string(c))]; !ok {
+		return errors.New("missing")
+	}
+	return nil
+}
+
+// json响应体中Path处的值等于Value, Path如data.items[0].id
+// 字符串按原值比较, 其他类型按json编码比较, 如1, true, null
+type JSONPathEquals struct {
+	Path  string
+	Value string
+}
+
+func (c JSONPathEquals) Name() string {
+	return fmt.Sprintf("json %s == %s", c.Path, c.Value)
+}
+
+func (c JSONPathEquals) Verify(in *CheckInput) error {
+	return verifyJSONPath(in, c.Path, c.Value)
+}
+
+// grpc响应消息中Path处的字段等于Value, 字段名为proto中的原始名称, 路径及比较规则同JSONPathEquals
+// 枚举按名称比较, int64等按十进制字符串比较
+type ProtoFieldEquals struct {
+	Path  string
+	Value string
+}
+
+func (c ProtoFieldEquals) Name() string {
+	return fmt.Sprintf("proto %s == %s", c.Path, c.Value)
+}
+
+func (c ProtoFieldEquals) Verify(in *CheckInput) error {
+	if in.Message == nil {
+		return errors.New("no proto message")
+	}
+	return verifyJSONPath(in, c.Path, c.Value)
+}
+
+func verifyJSONPath(in *CheckInput, path, want string) error {
+	v, err := in.json()
+	if err != nil {
+		return err
+	}
+	v, err = jsonPathValue(v, path)
+	if err != nil {
+		return err
+	}
+	if got := jsonString(v); got != want {
+		return fmt.Errorf("got %.64s", got)
+	}
+	return nil
+}
+
+// 按路径取值: 以.分隔字段, [n]取数组元素, 可带$.前缀
+func jsonPathValue(v interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return v, nil
+	}
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		var indexes []string
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key = part[:i]
+			indexes = strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][")
+		}
+		if key != "" {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: not an object", key)
+			}
+			if v, ok = m[key]; !ok {
+				return nil, fmt.Errorf("%s: not found", key)
+			}
+		}
+		for _, idx := range indexes {
+			n, err := strconv.Atoi(idx)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q", idx)
+			}
+			arr, ok := v.([]interface{})
+			if !ok || n < 0 || n >= len(arr) {
+				return nil, fmt.Errorf("%s[%d]: out of range", key, n)
+			}
+			v = arr[n]
+		}
+	}
+	return v, nil
+}
+
+// 响应大小在[Min, Max]内, Max为0表示不限
+type SizeBetween struct {
+	Min int
+	Max int
+}
+
+func (c SizeBetween) Name() string {
+	if c.Max <= 0 {
+		return fmt.Sprintf("size >= %d", c.Min)
+	}
+	return fmt.Sprintf("size in [%d, %d]", c.Min, c.Max)
+}
+
+func (c SizeBetween) Verify(in *CheckInput) error {
+	if in.Size < c.Min || (c.Max > 0 && in.Size > c.Max) {
+		return fmt.Errorf("size %d", in.Size)
+	}
+	return nil
+}
+
+// 解析检查描述, 格式:
+//
+//	status:200,201
+//	contains:ok
+//	regex:"id":\d+
+//	json:data.items[0].id=1
+//	proto:reply.message=hello
+//	header:X-Request-Id
+//	size:10,1024
+func ParseCheck(spec string) (Check, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "status":
+		var codes StatusIn
+		for _, s := range strings.Split(arg, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("check %q: %v", spec, err)
+			}
+			codes = append(codes, code)
+		}
+		return codes, nil
+	case "contains":
+		return BodyContains(arg), nil
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("check %q: %v", spec, err)
+		}
+		return BodyMatches{Pattern: re}, nil
+	case "json", "proto":
+		i := strings.IndexByte(arg, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("check %q needs path=value", spec)
+		}
+		if kind == "proto" {
+			return ProtoFieldEquals{Path: arg[:i], Value: arg[i+1:]}, nil
+		}
+		return JSONPathEquals{Path: arg[:i], Value: arg[i+1:]}, nil
+	case "header":
+		return HeaderPresent(arg), nil
+	case "size":
+		parts := strings.Split(arg, ",")
+		c := SizeBetween{}
+		var err error
+		if c.Min, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+			return nil, fmt.Errorf("check %q: %v", spec, err)
+		}
+		if len(parts) > 1 {
+			if c.Max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+				return nil, fmt.Errorf("check %q: %v", spec, err)
+			}
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown check %q", spec)
+	}
+}
+
+// 单个检查的结果, 随Response上报
+type CheckResult struct {
+	Name   string
+	Passed bool
+}
+
+// 统计项中单个检查的通过情况
+type CheckStats struct {
+	Name   string `json:"name"`
+	Passed uint64 `json:"passed"`
+	Failed uint64 `json:"failed"`
+}
+
+func (c CheckStats) PassRate() float64 {
+	if c.Passed+c.Failed == 0 {
+		return 0
+	}
+	return float64(c.Passed) * 100 / float64(c.Passed+c.Failed)
+}
+
+type checkCounter map[string]*CheckStats
+
+func (c checkCounter) add(results []CheckResult) {
+	for _, r := range results {
+		st := c[r.Name]
+		if st == nil {
+			st = &CheckStats{Name: r.Name}
+			c[r.Name] = st
+		}
+		if r.Passed {
+			st.Passed++
+		} else {
+			st.Failed++
+		}
+	}
+}
+
+func (c checkCounter) clone() checkCounter {
+	res := make(checkCounter, len(c))
+	for name, st := range c {
+		cp := *st
+		res[name] = &cp
+	}
+	return res
+}
+
+// 按名称排序
+func (c checkCounter) snapshot() []CheckStats {
+	if len(c) == 0 {
+		return nil
+	}
+	res := make([]CheckStats, 0, len(c))
+	for _, st := range c {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// 执行检查并将结果写入result, failOnCheck为true时不通过的成功请求记为失败(ERR_CODE_CHECK)
+func runChecks(result *Response, in *CheckInput, checks []Check, failOnCheck bool) {
+	for _, c := range checks {
+		err := c.Verify(in)
+		result.Checks = append(result.Checks, CheckResult{Name: c.Name(), Passed: err == nil})
+		if err != nil && failOnCheck && result.IsSucceed {
+			result.IsSucceed = false
+			result.ErrCode = ERR_CODE_CHECK
+			result.ErrMsg = fmt.Sprintf("check %s failed: %v", c.Name(), err)
+		}
+	}
+}
+
+// 没有可检查的响应时, 将检查及提取规则记为不通过
+func failChecks(result *Response, checks []Check, extract *extractState) {
+	for _, c := range checks {
+		result.Checks = append(result.Checks, CheckResult{Name: c.Name(), Passed: false})
+	}
+	if extract != nil {
+		for _, e := range extract.extractors {
+			result.Checks = append(result.Checks, CheckResult{Name: "extract " + e.Var(), Passed: false})
+		}
+	}
+}
+
+type checksKey struct{}
+
+// 返回附加了检查的ctx, 以该ctx发起的http请求由HTTPCheckFilter一并检查
+func WithChecks(ctx context.Context, checks ...Check) context.Context {
+	if len(checks) == 0 {
+		return ctx
+	}
+	if old, ok := ctx.Value(checksKey{}).([]Check); ok {
+		checks = append(append([]Check(nil), old...), checks...)
+	}
+	return context.WithValue(ctx, checksKey{}, checks)
+}
+
+// 包装HTTPClientInterceptor的filter: 先执行filter, 再对收到的响应执行checks及请求ctx中WithChecks附加的检查
+// 之后按请求ctx中WithExtractors附加的规则提取变量
+// 请求出错(没有响应)或读取响应体失败时, 所有检查及提取均记为不通过, 变量保持原值
+func HTTPCheckFilter(checks []Check, failOnCheck bool, filter func(result *Response, req *http.Request, rsp *http.Response, err error)) func(result *Response, req *http.Request, rsp *http.Response, err error) {
+	return func(result *Response, req *http.Request, rsp *http.Response, err error) {
+		if filter != nil {
+			filter(result, req, rsp, err)
+		}
+		all := checks
+		if extra, ok := req.Context().Value(checksKey{}).([]Check); ok {
+			all = append(append([]Check(nil), checks...), extra...)
+		}
+		extract, _ := req.Context().Value(extractKey{}).(*extractState)
+		if len(all) == 0 && extract == nil {
+			return
+		}
+		if err != nil || rsp == nil {
+			failChecks(result, all, extract)
+			return
+		}
+		body, rerr := ioutil.ReadAll(rsp.Body)
+		rsp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if rerr != nil {
+			failChecks(result, all, extract)
+			return
+		}
+		in := &CheckInput{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: body, Size: len(body)}
+		runChecks(result, in, all, failOnCheck)
+		if extract != nil {
+			runExtractors(result, in, extract.vars, extract.extractors, failOnCheck)
+		}
+	}
+}
+
+// 包装GRPCClientInterceptor的filter: 先执行filter, 再对响应执行checks, 状态码为grpc状态码
+// 请求出错时没有响应消息, proto字段检查视为不通过
+func GRPCCheckFilter(checks []Check, failOnCheck bool, filter func(result *Response, req, rsp interface{}, err error)) func(result *Response, req, rsp interface{}, err error) {
+	return func(result *Response, req, rsp interface{}, err error) {
+		if filter != nil {
+			filter(result, req, rsp, err)
+		}
+		if len(checks) == 0 {
+			return
+		}
+		in := &CheckInput{StatusCode: int(status.Code(err)), Size: int(result.ReceivedBytes)}
+		if m, ok := rsp.(proto.Message); ok && err == nil {
+			in.Message = m
+		}
+		runChecks(result, in, checks, failOnCheck)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package kite
+
+import (
+	"syscall"
+	"time"
+)
+
+// 进程累计cpu时间(用户态+内核态)
+func processCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package kite
+
+import (
+	"syscall"
+	"time"
+)
+
+// 进程累计cpu时间(用户态+内核态)
+func processCPUTime() time.Duration {
+	var creation, exit, kernel, user syscall.Filetime
+	handle, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	err = syscall.GetProcessTimes(handle, &creation, &exit, &kernel, &user)
+	if err != nil {
+		return 0
+	}
+	// Filetime单位为100纳秒
+	ticks := func(ft syscall.Filetime) int64 {
+		return int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+	}
+	return time.Duration((ticks(kernel) + ticks(user)) * 100)
+}
@@ -0,0 +1,196 @@
+package kite
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const dashHistoryLen = 40
+
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// 实时面板的区间统计数据
+type dashSnapshot struct {
+	Header
+	qps           float64
+	p50, p90, p99 float64
+	successNum    uint64
+	failureNum    uint64
+	errors        ErrCodes
+}
+
+// 终端实时面板, 原地刷新并响应按键: p暂停 r恢复 q中止
+type dashboard struct {
+	ctl       *runControl
+	out       io.Writer
+	mu        sync.Mutex
+	stopped   bool
+	restore   func()
+	polling   bool          // 终端读取会超时返回, 停止时可等待读按键的goroutine退出
+	keysDone  chan struct{} // 读按键的goroutine退出时关闭
+	snapshots []*dashSnapshot
+	history   map[Header][]float64 // qps历史, 用于绘制sparkline
+}
+
+func newDashboard(ctl *runControl) *dashboard {
+	return &dashboard{
+		ctl:      ctl,
+		out:      os.Stdout,
+		history:  make(map[Header][]float64),
+		keysDone: make(chan struct{}),
+	}
+}
+
+func (d *dashboard) start() {
+	d.restore, d.polling = enterRawMode()
+	go d.readKeys()
+	d.mu.Lock()
+	d.render()
+	d.mu.Unlock()
+}
+
+// 非polling模式(如windows)下读取阻塞, 停止后goroutine在下一次输入时才退出, 该输入被丢弃
+func (d *dashboard) readKeys() {
+	defer close(d.keysDone)
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		d.mu.Lock()
+		if d.stopped {
+			d.mu.Unlock()
+			return
+		}
+		if n == 0 {
+			d.mu.Unlock()
+			// polling模式下读超时返回io.EOF
+			if err != nil && (err != io.EOF || !d.polling) {
+				return
+			}
+			continue
+		}
+		switch buf[0] {
+		case 'p', 'P':
+			d.ctl.pause()
+		case 'r', 'R':
+			d.ctl.resume()
+		case 'q', 'Q':
+			d.ctl.abort()
+		}
+		d.render()
+		d.mu.Unlock()
+	}
+}
+
+func (d *dashboard) update(snapshots []*dashSnapshot) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].MsgType != snapshots[j].MsgType {
+			return snapshots[i].MsgType < snapshots[j].MsgType
+		}
+		if snapshots[i].Method != snapshots[j].Method {
+			return snapshots[i].Method < snapshots[j].Method
+		}
+		return snapshots[i].Tags < snapshots[j].Tags
+	})
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	for _, snap := range snapshots {
+		h := append(d.history[snap.Header], snap.qps)
+		if len(h) > dashHistoryLen {
+			h = h[len(h)-dashHistoryLen:]
+		}
+		d.history[snap.Header] = h
+	}
+	d.snapshots = snapshots
+	d.render()
+}
+
+// 停止刷新并恢复终端, 之后的最终报告通过LogFunc输出
+func (d *dashboard) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	d.render()
+	d.stopped = true
+	if d.polling {
+		// 等待读按键的goroutine退出(最多一次读超时)后再恢复终端, 避免其读走之后的输入
+		d.mu.Unlock()
+		<-d.keysDone
+		d.mu.Lock()
+	}
+	if d.restore != nil {
+		d.restore()
+	}
+	fmt.Fprintln(d.out)
+}
+
+func (d *dashboard) render() {
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	state := "running"
+	if d.ctl.aborted() {
+		state = "aborted"
+	} else if d.ctl.paused() {
+		state = "paused"
+	}
+	fmt.Fprintf(&b, "Kite dashboard   状态: %s   [p]暂停 [r]恢复 [q]中止\r\n", state)
+	elapsed := time.Since(d.ctl.start)
+	done := atomic.LoadUint64(&d.ctl.done)
+	planned := d.ctl.planned
+	active := atomic.LoadInt64(&d.ctl.active)
+	if planned == 0 && d.ctl.duration > 0 {
+		// 仅按时长结束时以计划时长(暂停期间顺延)显示进度
+		running := elapsed - d.ctl.pausedFor()
+		fmt.Fprintf(&b, "耗时 %.0fs / 计划 %.0fs   进度 %.1f%% (%d)   活跃worker %d\r\n",
+			elapsed.Seconds(), d.ctl.duration.Seconds(), math.Min(running.Seconds()/d.ctl.duration.Seconds(), 1)*100, done, active)
+	} else {
+		progress := float64(0)
+		estimate := "-"
+		if planned > 0 {
+			progress = float64(done) / float64(planned)
+		}
+		if done > 0 && planned > 0 {
+			estimate = fmt.Sprintf("%.0fs", elapsed.Seconds()/progress)
+		}
+		fmt.Fprintf(&b, "耗时 %.0fs / 预计 %s   进度 %.1f%% (%d/%d)   活跃worker %d\r\n",
+			elapsed.Seconds(), estimate, progress*100, done, planned, active)
+	}
+	for _, snap := range d.snapshots {
+		b.WriteString("────────────────────────────────────────────────────────────\r\n")
+		fmt.Fprintf(&b, "%s\r\n", snap.Title())
+		fmt.Fprintf(&b, "  qps %8.2f   p50 %6.2fms  p90 %6.2fms  p99 %6.2fms   成功 %d  失败 %d\r\n",
+			snap.qps, snap.p50, snap.p90, snap.p99, snap.successNum, snap.failureNum)
+		fmt.Fprintf(&b, "  错误码 %s\r\n", snap.errors.Format(snap.MsgType))
+		fmt.Fprintf(&b, "  qps %s\r\n", sparkline(d.history[snap.Header]))
+	}
+	io.WriteString(d.out, b.String())
+}
+
+func sparkline(values []float64) string {
+	max := float64(0)
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	runes := make([]rune, len(values))
+	for i, v := range values {
+		idx := 0
+		if max > 0 {
+			idx = int(v / max * float64(len(sparkTicks)-1))
+		}
+		runes[i] = sparkTicks[idx]
+	}
+	return string(runes)
+}
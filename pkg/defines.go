@@ -2,8 +2,12 @@ package kite
 
 import (
 	"fmt"
+	"net/http"
 	"sort"
 	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
 )
 
 type ReqHandler interface {
@@ -17,12 +21,62 @@ type NewReqHandlerFunc func() ReqHandler
 type LogFunc func(format string, a ...interface{}) (n int, err error)
 
 type Config struct {
-	ConcurrencyNum    int
-	StatFreqSec       int
-	ResultsBufferSize int
-	ReqNumPerConcy    int
+	ConcurrencyNum     int
+	StatFreqSec        int
+	ResultsBufferSize  int
+	ReqNumPerConcy     int
+	HTMLReportPath     string // 非空时压测结束后输出html报告
+	Dashboard          bool   // 终端实时面板, 开启后不再定期输出统计表
+	InitFailPolicy     InitFailPolicy
+	InitRetryNum       int              // InitFailRetry时的最大重试次数
+	InitRetryBackoffMS int              // 首次重试间隔, 之后每次翻倍
+	MaxPanics          int              // ReqHandler累计panic达到该次数时中止运行, 0表示不限
+	Percentiles        []float64        // 输出的延迟百分位, 如99.9, 默认DefaultPercentiles
+	Histogram          *HistogramConfig // 延迟直方图的分桶方式, 默认10个等宽桶
+	RequestTimeoutMS   int              // 单次OnRequest(Context)的超时, 0表示不限
+	Retry              *RetryPolicy     // OnRequest失败后的重试策略, nil表示不重试
+	ThinkTime          Distribution     // 每次迭代结束后的思考时间, nil表示不等待
+	PacingMS           int              // 固定迭代间隔(含请求耗时), 非0时忽略ThinkTime
+	DurationSec        int              // 压测时长, 0表示不限; 同时配置ReqNumPerConcy时先到者结束
+	WarmupSec          int              // 预热时长, 期间的结果不计入统计
+	WarmupReqNum       int              // 预热结果数, 与WarmupSec同时配置时两者都满足才结束预热
+	Scenario           string           // 场景名, 填入Response.Scenario
+	GroupBy            []string         // 除消息类型及命令字外, 按这些标签(Response.Tags或step, scenario)分别统计
+	URLRules           *URLRules        // http命令字的url归一化规则
+	MaxReportNum       int              // 统计项数上限(含[OTHER]), 超出后新的统计项归入[OTHER], 0表示不限
+	ErrSampleNum       int              // 每个统计项每个错误码保留的错误信息条数(含合并项), 默认5
+	// 非nil时为开环压测: 按到达过程发起请求, ConcurrencyNum为worker数, ThinkTime及PacingMS无效
+	Arrival ArrivalProcess
+	// 所有worker结束后, 结果通道关闭前调用, 可继续上报结果(如等待消息队列消费完成)
+	OnWorkersDone func(results chan<- *Response)
 }
 
+// 直方图分桶方式
+type HistogramMode int
+
+const (
+	HistogramLinear   HistogramMode = iota // 最小值到最大值等宽分桶
+	HistogramLog                           // 对数刻度上等距分桶
+	HistogramExp                           // 桶宽度按Factor倍增
+	HistogramExplicit                      // 使用Bounds指定的边界
+)
+
+type HistogramConfig struct {
+	Mode      HistogramMode
+	BucketNum int       // 桶数, 默认10, HistogramExplicit时无效
+	Factor    float64   // HistogramExp的倍数, 默认2
+	Bounds    []float64 // HistogramExplicit的桶边界(毫秒), 超出最后边界的归入最大值桶
+}
+
+// ReqHandler.Init失败时的处理策略
+type InitFailPolicy int
+
+const (
+	InitFailContinue InitFailPolicy = iota // 该worker退出, 其余worker继续
+	InitFailAbort                          // 中止整个运行
+	InitFailRetry                          // 按退避间隔重试Init
+)
+
 // 请求内容
 type Request struct {
 	Url string
@@ -36,24 +90,64 @@ type Response struct {
 	IsSucceed     bool   // 是否请求成功
 	ErrCode       int    // 错误码
 	ReceivedBytes uint64
+	SentBytes     uint64        // 发送字节数
+	Attempt       int           // 调度器重试中的尝试序号, 1为首次, 0表示未知(按首次统计)
+	ErrMsg        string        // 失败时的错误信息, 统计中按错误码采样
+	Checks        []CheckResult // 响应检查结果, 统计中按检查名称计数
+	NoLatency     bool          // 没有耗时的事件(如服务端推送, 连接断开), 只计数不计入延迟统计
+	// 以下由FillResponse根据ctx中的RunState填充, 未经过调度器时为零值
+	StartTime time.Time         // 请求开始时间, 未填写时由SendResponse按UseTime推算
+	Worker    int               // worker序号
+	Iteration int               // 迭代序号, 从1开始
+	Scenario  string            // 场景名
+	Step      string            // 步骤名
+	Tags      map[string]string // 自定义标签
 }
 
 type MsgType int
 
 const (
-	MSG_GRPC MsgType = 1
-	MSG_MQ   MsgType = 2
-	MSG_HTTP MsgType = 3
+	MSG_HANDLER MsgType = -1 // ReqHandler生命周期(Init/OnRequest)的失败统计
+	MSG_GRPC    MsgType = 1
+	MSG_MQ      MsgType = 2
+	MSG_HTTP    MsgType = 3
+	MSG_WS      MsgType = 4
+	MSG_TCP     MsgType = 5
+	MSG_UDP     MsgType = 6
+	MSG_AUTH    MsgType = 7 // 获取token及签名
+)
+
+// kite内部错误码
+const (
+	ERR_CODE_REQUEST = -1001 // 请求失败
+	ERR_CODE_HANDLER = -1002 // ReqHandler返回错误
+	ERR_CODE_PANIC   = -1003 // ReqHandler发生panic
+	ERR_CODE_TIMEOUT = -1004 // 等待响应超时
+	ERR_CODE_CHECK   = -1005 // 响应检查不通过
+	ERR_CODE_MQ_DUP  = -1101 // 消息重复投递
+	ERR_CODE_MQ_LOST = -1102 // 已确认的消息未被消费
+
+	ERR_CODE_UNMATCHED = -1201 // 无法匹配请求的响应帧(如超时后才到达)
 )
 
 func (mt MsgType) String() string {
 	switch mt {
+	case MSG_HANDLER:
+		return "handler"
 	case MSG_GRPC:
 		return "grpc"
 	case MSG_MQ:
 		return "mq"
 	case MSG_HTTP:
 		return "http"
+	case MSG_WS:
+		return "websocket"
+	case MSG_TCP:
+		return "tcp"
+	case MSG_UDP:
+		return "udp"
+	case MSG_AUTH:
+		return "auth"
 	default:
 		if name, ok := usrMsgTypes[mt]; ok {
 			return name
@@ -64,6 +158,48 @@ func (mt MsgType) String() string {
 
 var usrMsgTypes = make(map[MsgType]string)
 
+// 错误码名称: 优先使用RegisterErrCode为该消息类型注册的名称, 其次为kite内部错误码
+// grpc及http(含auth)消息类型下分别按grpc状态码及http状态码自动命名, 均未命中时为空
+func ErrCodeName(mt MsgType, code int) string {
+	if name, ok := usrErrCodes[errCodeKey{mt, code}]; ok {
+		return name
+	}
+	switch code {
+	case ERR_CODE_REQUEST:
+		return "request_failed"
+	case ERR_CODE_HANDLER:
+		return "handler_error"
+	case ERR_CODE_PANIC:
+		return "panic"
+	case ERR_CODE_TIMEOUT:
+		return "timeout"
+	case ERR_CODE_CHECK:
+		return "check_failed"
+	case ERR_CODE_MQ_DUP:
+		return "mq_duplicate"
+	case ERR_CODE_MQ_LOST:
+		return "mq_lost"
+	case ERR_CODE_UNMATCHED:
+		return "unmatched"
+	}
+	switch mt {
+	case MSG_GRPC:
+		if code >= int(codes.OK) && code <= int(codes.Unauthenticated) {
+			return codes.Code(code).String()
+		}
+	case MSG_HTTP, MSG_AUTH:
+		return http.StatusText(code)
+	}
+	return ""
+}
+
+type errCodeKey struct {
+	mt   MsgType
+	code int
+}
+
+var usrErrCodes = make(map[errCodeKey]string)
+
 type LatencyBucket struct {
 	// The Mark for histogram bucket in milliseconds
 	Mark float64 `json:"mark"`
@@ -78,10 +214,27 @@ type LatencyBucket struct {
 // LatencyDistribution holds latency distribution data
 type LatencyDistribution struct {
 	Percentage int `json:"percentage"`
+	// The exact percentile, may be fractional such as 99.9; Percentage is its integer part
+	Percentile float64 `json:"percentile"`
 	// The Mark for distribution in milliseconds
 	Latency float64 `json:"latency"`
 }
 
+// TimePoint holds statistics of one sample interval
+type TimePoint struct {
+	// Offset from the start of the run in seconds
+	OffsetSec    float64 `json:"offset_sec"`
+	SuccessNum   uint64  `json:"success_num"`
+	FailureNum   uint64  `json:"failure_num"`
+	QPS          float64 `json:"qps"`
+	AvgLatencyMS float64 `json:"avg_latency_ms"`
+	P50LatencyMS float64 `json:"p50_latency_ms"`
+	P99LatencyMS float64 `json:"p99_latency_ms"`
+	MaxLatencyMS float64 `json:"max_latency_ms"`
+
+	latencies []float64 // 区间内的升序延迟记录, 仅容量搜索的阶段保留
+}
+
 // 统计错误码
 type ErrCodes map[int]int
 
@@ -93,3 +246,23 @@ func (e ErrCodes) String() string {
 	sort.Strings(list)
 	return strings.Join(list, ";")
 }
+
+// 带名称及占比的错误码统计, 按错误码升序, 如"-1001(request_failed):37(3.70%);200(OK):963(96.30%)"
+func (e ErrCodes) Format(mt MsgType) string {
+	codes := make([]int, 0, len(e))
+	total := 0
+	for k, v := range e {
+		codes = append(codes, k)
+		total += v
+	}
+	sort.Ints(codes)
+	list := make([]string, 0, len(codes))
+	for _, code := range codes {
+		item := fmt.Sprint(code)
+		if name := ErrCodeName(mt, code); name != "" {
+			item += "(" + name + ")"
+		}
+		list = append(list, fmt.Sprintf("%s:%d(%.2f%%)", item, e[code], float64(e[code])*100/float64(total)))
+	}
+	return strings.Join(list, ";")
+}
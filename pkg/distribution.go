@@ -0,0 +1,164 @@
+package kite
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 随机时长分布, 用于模拟延迟等
+type Distribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// 固定值
+type FixedDist struct {
+	Value time.Duration
+}
+
+func (d FixedDist) Sample(r *rand.Rand) time.Duration {
+	return d.Value
+}
+
+// 正态分布, 小于0的采样截断为0
+type NormalDist struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (d NormalDist) Sample(r *rand.Rand) time.Duration {
+	v := time.Duration(r.NormFloat64()*float64(d.StdDev)) + d.Mean
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// 均匀分布[Min, Max)
+type UniformDist struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (d UniformDist) Sample(r *rand.Rand) time.Duration {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + time.Duration(r.Int63n(int64(d.Max-d.Min)))
+}
+
+// 指数分布, 均值为Mean, Max非0时截断
+type ExpDist struct {
+	Mean time.Duration
+	Max  time.Duration
+}
+
+func (d ExpDist) Sample(r *rand.Rand) time.Duration {
+	v := time.Duration(r.ExpFloat64() * float64(d.Mean))
+	if d.Max > 0 && v > d.Max {
+		return d.Max
+	}
+	return v
+}
+
+// 长尾(帕累托)分布: 最小值为Min, Alpha越小尾部越长, Max非0时截断
+type LongTailDist struct {
+	Min   time.Duration
+	Alpha float64
+	Max   time.Duration
+}
+
+func (d LongTailDist) Sample(r *rand.Rand) time.Duration {
+	alpha := d.Alpha
+	if alpha <= 0 {
+		alpha = 1.5
+	}
+	v := time.Duration(float64(d.Min) / math.Pow(1-r.Float64(), 1/alpha))
+	if d.Max > 0 && v > d.Max {
+		return d.Max
+	}
+	return v
+}
+
+// 解析分布描述, 格式:
+//
+//	fixed:10ms
+//	uniform:1s,3s
+//	exp:2s[,10s]
+//	normal:10ms,2ms
+//	longtail:5ms,1.5[,1s]
+func ParseDistribution(spec string) (Distribution, error) {
+	kind, args := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, args = spec[:i], spec[i+1:]
+	}
+	params := strings.Split(args, ",")
+	durations := func(n int) ([]time.Duration, error) {
+		if len(params) < n {
+			return nil, fmt.Errorf("distribution %q needs %d params", spec, n)
+		}
+		res := make([]time.Duration, n)
+		for i := 0; i < n; i++ {
+			d, err := time.ParseDuration(strings.TrimSpace(params[i]))
+			if err != nil {
+				return nil, fmt.Errorf("distribution %q: %v", spec, err)
+			}
+			res[i] = d
+		}
+		return res, nil
+	}
+	switch kind {
+	case "fixed":
+		ds, err := durations(1)
+		if err != nil {
+			return nil, err
+		}
+		return FixedDist{Value: ds[0]}, nil
+	case "uniform":
+		ds, err := durations(2)
+		if err != nil {
+			return nil, err
+		}
+		return UniformDist{Min: ds[0], Max: ds[1]}, nil
+	case "exp":
+		ds, err := durations(1)
+		if err != nil {
+			return nil, err
+		}
+		d := ExpDist{Mean: ds[0]}
+		if len(params) > 1 {
+			if d.Max, err = time.ParseDuration(strings.TrimSpace(params[1])); err != nil {
+				return nil, fmt.Errorf("distribution %q: %v", spec, err)
+			}
+		}
+		return d, nil
+	case "normal":
+		ds, err := durations(2)
+		if err != nil {
+			return nil, err
+		}
+		return NormalDist{Mean: ds[0], StdDev: ds[1]}, nil
+	case "longtail":
+		ds, err := durations(1)
+		if err != nil {
+			return nil, err
+		}
+		d := LongTailDist{Min: ds[0]}
+		if len(params) > 1 {
+			if d.Alpha, err = strconv.ParseFloat(strings.TrimSpace(params[1]), 64); err != nil {
+				return nil, fmt.Errorf("distribution %q: %v", spec, err)
+			}
+		}
+		if len(params) > 2 {
+			if d.Max, err = time.ParseDuration(strings.TrimSpace(params[2])); err != nil {
+				return nil, fmt.Errorf("distribution %q: %v", spec, err)
+			}
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unknown distribution %q", spec)
+	}
+}
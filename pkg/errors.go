@@ -0,0 +1,84 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrRunAborted = errors.New("kite: run aborted")
+
+// ReqHandler方法中被恢复的panic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Run返回的汇总错误
+type RunError struct {
+	Workers      int            // worker总数
+	InitFailures int            // Init最终失败的worker数
+	InitErrors   map[string]int // Init错误信息=>次数
+	Aborted      bool           // 运行是否被中止
+}
+
+func (e *RunError) Error() string {
+	reasons := make([]string, 0, len(e.InitErrors))
+	for msg, num := range e.InitErrors {
+		reasons = append(reasons, fmt.Sprintf("%s (x%d)", msg, num))
+	}
+	sort.Strings(reasons)
+	s := fmt.Sprintf("kite: %d/%d workers failed to init: %s", e.InitFailures, e.Workers, strings.Join(reasons, "; "))
+	if e.Aborted {
+		s += ", run aborted"
+	}
+	return s
+}
+
+// 运行被中止时, errors.Is(err, ErrRunAborted)成立
+func (e *RunError) Unwrap() error {
+	if e.Aborted {
+		return ErrRunAborted
+	}
+	return nil
+}
+
+// 收集各worker的错误
+type errCollector struct {
+	mu           sync.Mutex
+	initFailures int
+	initErrors   map[string]int
+}
+
+func (c *errCollector) addInitError(err error) {
+	c.mu.Lock()
+	if c.initErrors == nil {
+		c.initErrors = make(map[string]int)
+	}
+	c.initFailures++
+	c.initErrors[err.Error()]++
+	c.mu.Unlock()
+}
+
+func (c *errCollector) result(workers int, aborted bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.initFailures == 0 {
+		if aborted {
+			return ErrRunAborted
+		}
+		return nil
+	}
+	return &RunError{
+		Workers:      workers,
+		InitFailures: c.initFailures,
+		InitErrors:   c.initErrors,
+		Aborted:      aborted,
+	}
+}
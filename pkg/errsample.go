@@ -0,0 +1,103 @@
+package kite
+
+import (
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultErrSampleNum = 5
+	maxErrMsgLen        = 256
+	otherErrMsg         = "(其他错误信息)"
+)
+
+// 某个错误码下的一条错误信息及其出现情况
+type ErrSample struct {
+	ErrCode   int       `json:"err_code"`
+	Name      string    `json:"name"` // 错误码名称, 见ErrCodeName
+	Message   string    `json:"message"`
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// 按错误码保留有限条不同的错误信息, 超出的计入otherErrMsg, 合并项计入条数上限
+type errSampler struct {
+	limit   int
+	samples map[int][]*ErrSample
+}
+
+func newErrSampler(limit int) *errSampler {
+	if limit <= 0 {
+		limit = defaultErrSampleNum
+	}
+	return &errSampler{limit: limit, samples: make(map[int][]*ErrSample)}
+}
+
+func (s *errSampler) add(code int, msg string, t time.Time) {
+	if len(msg) > maxErrMsgLen {
+		// 在字符边界截断, 避免截断多字节字符
+		i := maxErrMsgLen
+		for i > 0 && !utf8.RuneStart(msg[i]) {
+			i--
+		}
+		msg = msg[:i] + "..."
+	}
+	list := s.samples[code]
+	for _, sample := range list {
+		if sample.Message == msg {
+			sample.Count++
+			sample.LastSeen = t
+			return
+		}
+	}
+	// 超出上限后不同的信息合并为一条: 已满时最后一条改为合并项, 合并项始终为最后一条
+	if len(list) >= s.limit {
+		other := list[len(list)-1]
+		other.Message = otherErrMsg
+		other.Count++
+		other.LastSeen = t
+		return
+	}
+	s.samples[code] = append(list, &ErrSample{ErrCode: code, Message: msg, Count: 1, FirstSeen: t, LastSeen: t})
+}
+
+func (s *errSampler) clone() *errSampler {
+	if s == nil {
+		return nil
+	}
+	c := &errSampler{limit: s.limit, samples: make(map[int][]*ErrSample, len(s.samples))}
+	for code, list := range s.samples {
+		cl := make([]*ErrSample, len(list))
+		for i, sample := range list {
+			cp := *sample
+			cl[i] = &cp
+		}
+		c.samples[code] = cl
+	}
+	return c
+}
+
+// 按错误码升序, 同一错误码内按次数降序, 合并项排在最后
+func (s *errSampler) snapshot() []ErrSample {
+	if s == nil {
+		return nil
+	}
+	var res []ErrSample
+	for _, list := range s.samples {
+		for _, sample := range list {
+			res = append(res, *sample)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ErrCode != res[j].ErrCode {
+			return res[i].ErrCode < res[j].ErrCode
+		}
+		if (res[i].Message == otherErrMsg) != (res[j].Message == otherErrMsg) {
+			return res[j].Message == otherErrMsg
+		}
+		return res[i].Count > res[j].Count
+	})
+	return res
+}
@@ -0,0 +1,99 @@
+package kite
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestErrSamplerTruncate(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  string
+		want int // 截断后不含"..."的字节数
+	}{
+		{"short", "连接被拒绝", len("连接被拒绝")},
+		{"ascii", strings.Repeat("a", 300), maxErrMsgLen},
+		// 每个汉字3字节, 256不是3的倍数, 需退回到字符边界
+		{"multibyte", strings.Repeat("超", 100), maxErrMsgLen / 3 * 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newErrSampler(0)
+			s.add(ERR_CODE_REQUEST, c.msg, time.Now())
+			got := s.snapshot()[0].Message
+			if !utf8.ValidString(got) {
+				t.Errorf("message %q is not valid utf-8", got)
+			}
+			if n := len(strings.TrimSuffix(got, "...")); n != c.want {
+				t.Errorf("message length = %d, want %d", n, c.want)
+			}
+		})
+	}
+}
+
+func TestErrSamplerLimit(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit int
+		msgs  []string
+		want  []ErrSample // 只比较Message及Count
+	}{
+		{"within limit", 3, []string{"a", "b", "a"},
+			[]ErrSample{{Message: "a", Count: 2}, {Message: "b", Count: 1}}},
+		{"exactly full", 2, []string{"a", "b", "b"},
+			[]ErrSample{{Message: "b", Count: 2}, {Message: "a", Count: 1}}},
+		{"overflow merged into last", 3, []string{"a", "a", "b", "c", "d", "e", "a"},
+			[]ErrSample{{Message: "a", Count: 3}, {Message: "b", Count: 1}, {Message: otherErrMsg, Count: 3}}},
+		{"limit one", 1, []string{"a", "b", "c"},
+			[]ErrSample{{Message: otherErrMsg, Count: 3}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newErrSampler(c.limit)
+			for _, msg := range c.msgs {
+				s.add(ERR_CODE_REQUEST, msg, time.Now())
+			}
+			got := s.snapshot()
+			if len(got) > c.limit {
+				t.Errorf("%d samples exceed limit %d", len(got), c.limit)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("samples = %+v, want %+v", got, c.want)
+			}
+			for i := range got {
+				if got[i].Message != c.want[i].Message || got[i].Count != c.want[i].Count {
+					t.Errorf("sample %d = %q x%d, want %q x%d", i, got[i].Message, got[i].Count, c.want[i].Message, c.want[i].Count)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxReportNum(t *testing.T) {
+	cases := []struct {
+		name    string
+		max     int
+		methods []Header
+		want    int // 统计项数, 含[OTHER]
+	}{
+		{"unlimited", 0, []Header{{MSG_HTTP, "a", ""}, {MSG_HTTP, "b", ""}, {MSG_GRPC, "c", ""}}, 3},
+		{"within limit", 3, []Header{{MSG_HTTP, "a", ""}, {MSG_HTTP, "b", ""}, {MSG_HTTP, "a", ""}}, 2},
+		{"other counted", 3, []Header{{MSG_HTTP, "a", ""}, {MSG_HTTP, "b", ""}, {MSG_HTTP, "c", ""}, {MSG_GRPC, "d", ""}}, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Statistician{config: &Config{MaxReportNum: c.max}, statistics: make(map[Header]*StatisticData)}
+			for _, m := range c.methods {
+				h := s.header(&Response{MsgType: m.MsgType, Method: m.Method})
+				if s.statistics[h] == nil {
+					s.statistics[h] = &StatisticData{Header: h}
+				}
+			}
+			if len(s.statistics) != c.want {
+				t.Errorf("%d reports, want %d: %v", len(s.statistics), c.want, s.statistics)
+			}
+		})
+	}
+}
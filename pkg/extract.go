@@ -0,0 +1,218 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/status"
+)
+
+// 虚拟用户变量, 每个worker一份, 跨迭代保留, 用于在请求之间传递会话token, 创建的id等
+type Vars struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func NewVars() *Vars {
+	return &Vars{m: make(map[string]string)}
+}
+
+func (v *Vars) Get(name string) (string, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	val, ok := v.m[name]
+	return val, ok
+}
+
+func (v *Vars) Set(name, value string) {
+	v.mu.Lock()
+	v.m[name] = value
+	v.mu.Unlock()
+}
+
+var varRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// 将s中的${name}替换为变量值, 未定义的变量保持原样
+func (v *Vars) Expand(s string) string {
+	if v == nil || !strings.Contains(s, "${") {
+		return s
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return varRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if val, ok := v.m[ref[2:len(ref)-1]]; ok {
+			return val
+		}
+		return ref
+	})
+}
+
+// 从响应中提取值存入虚拟用户变量Var
+type Extractor interface {
+	Var() string
+	Extract(in *CheckInput) (string, error)
+}
+
+// 从json响应体中按路径提取, 路径规则同JSONPathEquals
+type ExtractJSON struct {
+	Name string
+	Path string
+}
+
+func (e ExtractJSON) Var() string { return e.Name }
+
+func (e ExtractJSON) Extract(in *CheckInput) (string, error) {
+	return extractJSONPath(in, e.Path)
+}
+
+// 从grpc响应消息中按字段路径提取, 字段名为proto中的原始名称
+type ExtractProto struct {
+	Name string
+	Path string
+}
+
+func (e ExtractProto) Var() string { return e.Name }
+
+func (e ExtractProto) Extract(in *CheckInput) (string, error) {
+	if in.Message == nil {
+		return "", errors.New("no proto message")
+	}
+	return extractJSONPath(in, e.Path)
+}
+
+func extractJSONPath(in *CheckInput, path string) (string, error) {
+	v, err := in.json()
+	if err != nil {
+		return "", err
+	}
+	if v, err = jsonPathValue(v, path); err != nil {
+		return "", err
+	}
+	return jsonString(v), nil
+}
+
+// 从响应体中按正则提取, Group为捕获组序号, 0表示整个匹配
+type ExtractRegex struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Group   int
+}
+
+func (e ExtractRegex) Var() string { return e.Name }
+
+func (e ExtractRegex) Extract(in *CheckInput) (string, error) {
+	m := e.Pattern.FindSubmatch(in.Body)
+	if m == nil || e.Group >= len(m) {
+		return "", errors.New("not matched")
+	}
+	return string(m[e.Group]), nil
+}
+
+// 提取响应头
+type ExtractHeader struct {
+	Name   string
+	Header string
+}
+
+func (e ExtractHeader) Var() string { return e.Name }
+
+func (e ExtractHeader) Extract(in *CheckInput) (string, error) {
+	vs, ok := in.Header[http.CanonicalHeaderKey(e.Header)]
+	if !ok || len(vs) == 0 {
+		return "", errors.New("missing")
+	}
+	return vs[0], nil
+}
+
+// 解析提取描述, 格式:
+//
+//	token=json:data.token
+//	id=regex:"id":(\d+)     有捕获组时取第一个捕获组
+//	csrf=header:X-CSRF-Token
+//	order=proto:order.id
+func ParseExtractor(spec string) (Extractor, error) {
+	i := strings.IndexByte(spec, '=')
+	j := strings.IndexByte(spec, ':')
+	if i <= 0 || j < i {
+		return nil, fmt.Errorf("extractor %q needs var=kind:arg", spec)
+	}
+	name, kind, arg := spec[:i], spec[i+1:j], spec[j+1:]
+	switch kind {
+	case "json":
+		return ExtractJSON{Name: name, Path: arg}, nil
+	case "proto":
+		return ExtractProto{Name: name, Path: arg}, nil
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("extractor %q: %v", spec, err)
+		}
+		group := 0
+		if re.NumSubexp() > 0 {
+			group = 1
+		}
+		return ExtractRegex{Name: name, Pattern: re, Group: group}, nil
+	case "header":
+		return ExtractHeader{Name: name, Header: arg}, nil
+	default:
+		return nil, fmt.Errorf("unknown extractor %q", spec)
+	}
+}
+
+// 执行提取并存入vars, 结果以"extract <变量名>"计入检查统计, 提取失败的处理同检查不通过
+func runExtractors(result *Response, in *CheckInput, vars *Vars, extractors []Extractor, failOnCheck bool) {
+	for _, e := range extractors {
+		val, err := e.Extract(in)
+		name := "extract " + e.Var()
+		result.Checks = append(result.Checks, CheckResult{Name: name, Passed: err == nil})
+		if err != nil {
+			if failOnCheck && result.IsSucceed {
+				result.IsSucceed = false
+				result.ErrCode = ERR_CODE_CHECK
+				result.ErrMsg = fmt.Sprintf("%s failed: %v", name, err)
+			}
+			continue
+		}
+		vars.Set(e.Var(), val)
+	}
+}
+
+type extractKey struct{}
+
+type extractState struct {
+	vars       *Vars
+	extractors []Extractor
+}
+
+// 返回附加了提取规则的ctx, 以该ctx发起的http请求由HTTPCheckFilter从响应中提取值存入vars
+func WithExtractors(ctx context.Context, vars *Vars, extractors ...Extractor) context.Context {
+	if len(extractors) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, extractKey{}, &extractState{vars: vars, extractors: extractors})
+}
+
+// 包装GRPCClientInterceptor的filter: 先执行filter, 再从响应消息中提取值存入vars
+// vars通常在ReqHandler.Init中创建, 与该worker的连接一一对应
+// grpc请求没有模板, ${name}不会自动替换, 需在构造请求消息时调用vars.Expand或Get
+func GRPCExtractFilter(vars *Vars, extractors []Extractor, failOnCheck bool, filter func(result *Response, req, rsp interface{}, err error)) func(result *Response, req, rsp interface{}, err error) {
+	return func(result *Response, req, rsp interface{}, err error) {
+		if filter != nil {
+			filter(result, req, rsp, err)
+		}
+		if len(extractors) == 0 {
+			return
+		}
+		in := &CheckInput{StatusCode: int(status.Code(err)), Size: int(result.ReceivedBytes)}
+		if m, ok := rsp.(proto.Message); ok && err == nil {
+			in.Message = m
+		}
+		runExtractors(result, in, vars, extractors, failOnCheck)
+	}
+}
@@ -0,0 +1,99 @@
+package kite
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseExtractor(t *testing.T) {
+	cases := []struct {
+		spec string
+		want Extractor // nil表示解析出错
+	}{
+		{"token=json:data.token", ExtractJSON{Name: "token", Path: "data.token"}},
+		{"order=proto:order.id", ExtractProto{Name: "order", Path: "order.id"}},
+		{"csrf=header:X-CSRF-Token", ExtractHeader{Name: "csrf", Header: "X-CSRF-Token"}},
+		{`id=regex:"id":(\d+)`, ExtractRegex{Name: "id", Pattern: regexp.MustCompile(`"id":(\d+)`), Group: 1}},
+		{`all=regex:\d+`, ExtractRegex{Name: "all", Pattern: regexp.MustCompile(`\d+`), Group: 0}},
+		{"token", nil},
+		{"=json:a", nil},
+		{"token:json=a", nil},
+		{"id=regex:(", nil},
+		{"x=xpath:/a", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			got, err := ParseExtractor(c.spec)
+			if c.want == nil {
+				if err == nil {
+					t.Errorf("got %+v, want error", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v (err %v), want %+v", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestExtractors(t *testing.T) {
+	in := &CheckInput{
+		StatusCode: 200,
+		Header:     http.Header{"X-Csrf-Token": {"abc"}},
+		Body:       []byte(`{"data": {"token": "t1", "ids": [7, 8]}, "id": 42}`),
+	}
+	cases := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"v=json:data.token", "t1", false},
+		{"v=json:data.ids[1]", "8", false},
+		{"v=json:data.missing", "", true},
+		{`v=regex:"id": (\d+)`, "42", false},
+		{`v=regex:"uid": (\d+)`, "", true},
+		{"v=header:x-csrf-token", "abc", false},
+		{"v=header:X-Missing", "", true},
+		{"v=proto:id", "", true}, // http响应没有proto消息
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			e, err := ParseExtractor(c.spec)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			got, err := e.Extract(in)
+			if got != c.want || (err != nil) != c.wantErr {
+				t.Errorf("extract = %q, %v, want %q (error %v)", got, err, c.want, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestVarsExpand(t *testing.T) {
+	vars := NewVars()
+	vars.Set("token", "t1")
+	vars.Set("user.id", "42")
+	cases := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"Bearer ${token}", "Bearer t1"},
+		{"/users/${user.id}/orders?t=${token}", "/users/42/orders?t=t1"},
+		{"${missing}-${token}", "${missing}-t1"},
+		{"${1bad}", "${1bad}"},
+		{"$token", "$token"},
+	}
+	for _, c := range cases {
+		if got := vars.Expand(c.in); got != c.want {
+			t.Errorf("Expand(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+	var nilVars *Vars
+	if got := nilVars.Expand("${token}"); got != "${token}" {
+		t.Errorf("nil vars Expand = %q", got)
+	}
+}
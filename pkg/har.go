@@ -0,0 +1,493 @@
+package kite
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HAR及curl导入选项
+type HTTPImportOptions struct {
+	// 只保留这些域名(含子域名)的请求, 为空时全部保留
+	Domains []string
+	// 去掉的请求头, 大小写不敏感, 默认去掉Content-Length等由传输层生成的头
+	DropHeaders []string
+}
+
+var defaultDropHeaders = []string{"Content-Length", "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Proxy-Connection", "Te", "Trailer"}
+
+func (opt *HTTPImportOptions) keepURL(u *url.URL) bool {
+	if opt == nil || len(opt.Domains) == 0 {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range opt.Domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (opt *HTTPImportOptions) keepHeader(name string) bool {
+	// http/2的伪头, 如:authority
+	if strings.HasPrefix(name, ":") {
+		return false
+	}
+	drops := defaultDropHeaders
+	if opt != nil && opt.DropHeaders != nil {
+		drops = opt.DropHeaders
+	}
+	for _, d := range drops {
+		if strings.EqualFold(d, name) {
+			return false
+		}
+	}
+	return true
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// 读取浏览器导出的HAR文件, 按开始时间生成场景, 保留方法, url, 请求头, 请求体及相对间隔
+func LoadHAR(r io.Reader, opt *HTTPImportOptions) (*HTTPScenario, error) {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("har: %v", err)
+	}
+	entries := har.Log.Entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+	sc := &HTTPScenario{}
+	var last time.Time
+	for i, e := range entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("har entry %d: %v", i, err)
+		}
+		// 跳过data:, chrome-extension:等非http请求
+		if (u.Scheme != "http" && u.Scheme != "https") || !opt.keepURL(u) {
+			continue
+		}
+		step := &HTTPStep{Method: e.Request.Method, URL: e.Request.URL, Header: make(http.Header)}
+		for _, h := range e.Request.Headers {
+			if opt.keepHeader(h.Name) {
+				step.Header.Add(h.Name, h.Value)
+			}
+		}
+		if pd := e.Request.PostData; pd != nil {
+			step.Body = []byte(pd.Text)
+			if pd.Encoding == "base64" {
+				if step.Body, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+					return nil, fmt.Errorf("har entry %d: %v", i, err)
+				}
+			}
+			if pd.MimeType != "" && step.Header.Get("Content-Type") == "" {
+				step.Header.Set("Content-Type", pd.MimeType)
+			}
+		}
+		if len(sc.Steps) > 0 {
+			step.Delay = e.StartedDateTime.Sub(last)
+		}
+		last = e.StartedDateTime
+		sc.Steps = append(sc.Steps, step)
+	}
+	if len(sc.Steps) == 0 {
+		return nil, errors.New("har: no request matched")
+	}
+	return sc, nil
+}
+
+// 读取curl命令列表, 每条命令一个请求, 以\结尾的行与下一行拼接, 忽略空行及#开头的行
+// curl命令不含时间信息, 生成的请求间隔均为0
+func LoadCurl(r io.Reader, opt *HTTPImportOptions) (*HTTPScenario, error) {
+	sc := &HTTPScenario{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var cmd strings.Builder
+	flush := func() error {
+		line := strings.TrimSpace(cmd.String())
+		cmd.Reset()
+		if line == "" {
+			return nil
+		}
+		step, err := ParseCurl(line)
+		if err != nil {
+			return err
+		}
+		u, err := url.Parse(step.URL)
+		if err != nil {
+			return err
+		}
+		if !opt.keepURL(u) {
+			return nil
+		}
+		for k := range step.Header {
+			if !opt.keepHeader(k) {
+				delete(step.Header, k)
+			}
+		}
+		sc.Steps = append(sc.Steps, step)
+		return nil
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if cmd.Len() == 0 && (trimmed == "" || trimmed[0] == '#') {
+			continue
+		}
+		if strings.HasSuffix(trimmed, "\\") {
+			cmd.WriteString(strings.TrimSuffix(trimmed, "\\"))
+			cmd.WriteByte(' ')
+			continue
+		}
+		cmd.WriteString(line)
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if len(sc.Steps) == 0 {
+		return nil, errors.New("curl: no request matched")
+	}
+	return sc, nil
+}
+
+// 不带参数且不影响请求内容的curl选项
+var curlIgnoredFlags = map[string]bool{
+	"-s": true, "--silent": true, "-S": true, "--show-error": true, "-k": true, "--insecure": true,
+	"-L": true, "--location": true, "-v": true, "--verbose": true, "-i": true, "--include": true,
+	"--compressed": true, "-f": true, "--fail": true, "-N": true, "--no-buffer": true, "--http1.1": true,
+	"--http2": true, "-g": true, "--globoff": true,
+}
+
+// 带一个参数且不影响请求内容的curl选项
+var curlIgnoredArgFlags = map[string]bool{
+	"-o": true, "--output": true, "-m": true, "--max-time": true, "--connect-timeout": true,
+	"-w": true, "--write-out": true, "-x": true, "--proxy": true, "--retry": true, "-c": true,
+	"--cookie-jar": true, "--cacert": true, "--cert": true, "--key": true, "--resolve": true,
+}
+
+// 解析一条curl命令(如浏览器"复制为cURL"的结果)为请求
+// 支持-X, -H, -d/--data*, --data-urlencode, -u, -b, -A, -e, -G, -I, --url, 不支持-F等表单上传
+func ParseCurl(cmd string) (*HTTPStep, error) {
+	args, err := splitShellWords(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || args[0] != "curl" {
+		return nil, fmt.Errorf("curl: not a curl command: %.40q", cmd)
+	}
+	args = expandCurlShortFlags(args)
+	step := &HTTPStep{Header: make(http.Header)}
+	var data []string
+	get, head := false, false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		// --opt=value形式
+		name, value, inline := arg, "", false
+		if strings.HasPrefix(arg, "--") {
+			if j := strings.IndexByte(arg, '='); j > 0 {
+				name, value, inline = arg[:j], arg[j+1:], true
+			}
+		}
+		next := func() (string, error) {
+			if inline {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("curl: option %s needs a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+		switch {
+		case !strings.HasPrefix(arg, "-") || arg == "-":
+			step.URL = arg
+		case curlIgnoredFlags[name]:
+		case curlIgnoredArgFlags[name]:
+			if _, err := next(); err != nil {
+				return nil, err
+			}
+		case name == "-G" || name == "--get":
+			get = true
+		case name == "-I" || name == "--head":
+			head = true
+		default:
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			switch name {
+			case "--url":
+				step.URL = v
+			case "-X", "--request":
+				step.Method = v
+			case "-H", "--header":
+				if j := strings.IndexByte(v, ':'); j > 0 {
+					step.Header.Add(strings.TrimSpace(v[:j]), strings.TrimSpace(v[j+1:]))
+				}
+			case "-d", "--data", "--data-ascii", "--data-binary", "--data-raw":
+				if strings.HasPrefix(v, "@") && name != "--data-raw" {
+					b, err := ioutil.ReadFile(v[1:])
+					if err != nil {
+						return nil, fmt.Errorf("curl: %v", err)
+					}
+					v = string(b)
+					if name != "--data-binary" {
+						v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+					}
+				}
+				data = append(data, v)
+			case "--data-urlencode":
+				if j := strings.IndexByte(v, '='); j >= 0 {
+					v = v[:j+1] + url.QueryEscape(v[j+1:])
+				} else {
+					v = url.QueryEscape(v)
+				}
+				data = append(data, v)
+			case "-u", "--user":
+				step.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(v)))
+			case "-b", "--cookie":
+				step.Header.Add("Cookie", v)
+			case "-A", "--user-agent":
+				step.Header.Set("User-Agent", v)
+			case "-e", "--referer":
+				step.Header.Set("Referer", v)
+			default:
+				return nil, fmt.Errorf("curl: unsupported option %s", name)
+			}
+		}
+	}
+	if step.URL == "" {
+		return nil, errors.New("curl: missing url")
+	}
+	if !strings.Contains(step.URL, "://") {
+		step.URL = "http://" + step.URL
+	}
+	body := strings.Join(data, "&")
+	switch {
+	case get && body != "":
+		sep := "?"
+		if strings.Contains(step.URL, "?") {
+			sep = "&"
+		}
+		step.URL += sep + body
+	case body != "":
+		step.Body = []byte(body)
+		if step.Header.Get("Content-Type") == "" {
+			step.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if step.Method == "" {
+		switch {
+		case head:
+			step.Method = http.MethodHead
+		case len(step.Body) > 0:
+			step.Method = http.MethodPost
+		default:
+			step.Method = http.MethodGet
+		}
+	}
+	return step, nil
+}
+
+// curl中带参数的短选项
+const curlShortArgFlags = "XHdubAeomwxc"
+
+// 展开组合的短选项, 如-sSL展开为-s -S -L, -XPOST展开为-X POST
+func expandCurlShortFlags(args []string) []string {
+	res := make([]string, 0, len(args))
+	for i, arg := range args {
+		if i == 0 || len(arg) <= 2 || arg[0] != '-' || arg[1] == '-' || curlTakesValue(args[i-1]) {
+			res = append(res, arg)
+			continue
+		}
+		for j := 1; j < len(arg); j++ {
+			res = append(res, "-"+arg[j:j+1])
+			if strings.IndexByte(curlShortArgFlags, arg[j]) >= 0 {
+				if j+1 < len(arg) {
+					res = append(res, arg[j+1:])
+				}
+				break
+			}
+		}
+	}
+	return res
+}
+
+// arg是否为需要单独参数的选项, 其后的参数不作为选项展开
+func curlTakesValue(arg string) bool {
+	if len(arg) == 2 && arg[0] == '-' {
+		return strings.IndexByte(curlShortArgFlags, arg[1]) >= 0
+	}
+	if strings.HasPrefix(arg, "--") && !strings.Contains(arg, "=") {
+		switch arg {
+		case "--url", "--request", "--header", "--data", "--data-ascii", "--data-binary", "--data-raw",
+			"--data-urlencode", "--user", "--cookie", "--user-agent", "--referer":
+			return true
+		}
+		return curlIgnoredArgFlags[arg]
+	}
+	return false
+}
+
+// 按shell规则切分参数: 支持单引号, 双引号, $'...'及反斜杠转义
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+				if s[i] != '\n' {
+					word.WriteByte(s[i])
+				}
+			}
+		case c == '\'':
+			inWord = true
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return nil, errors.New("curl: unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+		case c == '$' && i+1 < len(s) && s[i+1] == '\'':
+			inWord = true
+			n, err := ansiCQuoted(s[i+2:], &word)
+			if err != nil {
+				return nil, err
+			}
+			i += n + 2
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`\n", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("curl: unterminated double quote")
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// 解析$'...'中的内容直到结束的单引号, 返回消耗的字节数(含结束引号)
+func ansiCQuoted(s string, word *strings.Builder) (int, error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' {
+			return i + 1, nil
+		}
+		if c != '\\' || i+1 >= len(s) {
+			word.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			word.WriteByte('\n')
+		case 't':
+			word.WriteByte('\t')
+		case 'r':
+			word.WriteByte('\r')
+		case 'x':
+			var b byte
+			n := 0
+			for ; n < 2 && i+1 < len(s) && isHexDigit(s[i+1]); n++ {
+				i++
+				b = b<<4 | hexValue(s[i])
+			}
+			if n == 0 {
+				word.WriteString("\\x")
+			} else {
+				word.WriteByte(b)
+			}
+		case 'u':
+			var r rune
+			n := 0
+			for ; n < 4 && i+1 < len(s) && isHexDigit(s[i+1]); n++ {
+				i++
+				r = r<<4 | rune(hexValue(s[i]))
+			}
+			if n == 0 {
+				word.WriteString("\\u")
+			} else {
+				word.WriteRune(r)
+			}
+		default:
+			// \\, \', \"及其他字符原样保留
+			word.WriteByte(s[i])
+		}
+	}
+	return 0, errors.New("curl: unterminated $'' quote")
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
+}
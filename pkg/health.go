@@ -0,0 +1,223 @@
+package kite
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const healthSampleInterval = 100 * time.Millisecond
+
+// 运行中的结果通道对应的健康监控, 阻塞发送时据此记入所属的运行
+var healthMonitors sync.Map // chan<- *Response => *healthMonitor
+
+// 向结果通道发送Response, 通道已满时记录阻塞次数及时长
+// 自定义ReqHandler也应通过它上报结果
+func SendResponse(results chan<- *Response, result *Response) {
+	result.fillStartTime(time.Now())
+	select {
+	case results <- result:
+		return
+	default:
+	}
+	start := time.Now()
+	results <- result
+	if m, ok := healthMonitors.Load(results); ok {
+		m.(*healthMonitor).recordBlocked(time.Since(start))
+	}
+}
+
+// 压测端自身的健康状况
+type GeneratorHealth struct {
+	ResultsCap          int     // 结果通道容量
+	MaxResultsOccupancy float64 // 结果通道最大占用率
+	AvgResultsOccupancy float64 // 结果通道平均占用率
+	BlockedSends        uint64  // 阻塞的结果发送次数
+	BlockedMS           float64 // 结果发送阻塞总时长
+	MaxGoroutines       int
+	GCNum               uint32
+	GCPauseMS           float64
+	CPUUsage            float64 // 进程cpu占用率, 按核数归一化, 0~1
+	DispatchNum         uint64
+	AvgDispatchLagMS    float64 // 计划发起时间与实际发起时间的平均差
+	MaxDispatchLagMS    float64
+	Warnings            []string // 压测端可能成为瓶颈的提示
+}
+
+func (h *GeneratorHealth) Output(logfn LogFunc) {
+	logfn("Generator health:\n")
+	logfn("  结果通道占用 max %.0f%% avg %.0f%% (cap %d) | 阻塞发送 %d次 %.2fms | goroutine max %d | gc %d次 %.2fms | cpu %.0f%% | 发起延迟 avg %.3fms max %.3fms\n",
+		h.MaxResultsOccupancy*100, h.AvgResultsOccupancy*100, h.ResultsCap, h.BlockedSends, h.BlockedMS,
+		h.MaxGoroutines, h.GCNum, h.GCPauseMS, h.CPUUsage*100, h.AvgDispatchLagMS, h.MaxDispatchLagMS)
+	for _, w := range h.Warnings {
+		logfn("  WARNING: %s\n", w)
+	}
+}
+
+type healthMonitor struct {
+	blockedSends uint64 // 因结果通道已满而阻塞的发送次数
+	blockedNanos int64  // 阻塞总时长
+	warming      int32  // 预热期间为1, 不记录阻塞及发起延迟
+
+	results chan *Response
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+
+	mu            sync.Mutex
+	start         time.Time
+	startCPU      time.Duration
+	startGC       runtime.MemStats
+	samples       int
+	occupancySum  float64
+	maxOccupancy  float64
+	maxGoroutines int
+
+	dispatchNum      uint64
+	dispatchLagNanos int64
+	maxDispatchLag   int64
+}
+
+func newHealthMonitor(results chan *Response) *healthMonitor {
+	m := &healthMonitor{
+		results:  results,
+		start:    time.Now(),
+		stopCh:   make(chan struct{}),
+		startCPU: processCPUTime(),
+	}
+	runtime.ReadMemStats(&m.startGC)
+	return m
+}
+
+func (m *healthMonitor) run() {
+	healthMonitors.Store((chan<- *Response)(m.results), m)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(healthSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (m *healthMonitor) stop() {
+	healthMonitors.Delete((chan<- *Response)(m.results))
+	close(m.stopCh)
+	m.wg.Wait()
+}
+
+// 预热结束, 从此刻重新统计
+func (m *healthMonitor) endWarmup() {
+	m.mu.Lock()
+	m.start = time.Now()
+	m.startCPU = processCPUTime()
+	runtime.ReadMemStats(&m.startGC)
+	m.samples, m.occupancySum, m.maxOccupancy, m.maxGoroutines = 0, 0, 0, 0
+	m.mu.Unlock()
+	atomic.StoreInt32(&m.warming, 0)
+}
+
+func (m *healthMonitor) recordBlocked(d time.Duration) {
+	if atomic.LoadInt32(&m.warming) != 0 {
+		return
+	}
+	atomic.AddUint64(&m.blockedSends, 1)
+	atomic.AddInt64(&m.blockedNanos, int64(d))
+}
+
+func (m *healthMonitor) sample() {
+	occupancy := float64(0)
+	if cap(m.results) > 0 {
+		occupancy = float64(len(m.results)) / float64(cap(m.results))
+	}
+	goroutines := runtime.NumGoroutine()
+	m.mu.Lock()
+	m.samples++
+	m.occupancySum += occupancy
+	if occupancy > m.maxOccupancy {
+		m.maxOccupancy = occupancy
+	}
+	if goroutines > m.maxGoroutines {
+		m.maxGoroutines = goroutines
+	}
+	m.mu.Unlock()
+}
+
+// 记录一次请求的计划发起时间与实际发起时间
+func (m *healthMonitor) recordDispatch(scheduled, actual time.Time) {
+	if atomic.LoadInt32(&m.warming) != 0 {
+		return
+	}
+	lag := int64(actual.Sub(scheduled))
+	if lag < 0 {
+		lag = 0
+	}
+	atomic.AddUint64(&m.dispatchNum, 1)
+	atomic.AddInt64(&m.dispatchLagNanos, lag)
+	for {
+		max := atomic.LoadInt64(&m.maxDispatchLag)
+		if lag <= max || atomic.CompareAndSwapInt64(&m.maxDispatchLag, max, lag) {
+			return
+		}
+	}
+}
+
+func (m *healthMonitor) snapshot() *GeneratorHealth {
+	h := &GeneratorHealth{
+		ResultsCap:   cap(m.results),
+		BlockedSends: atomic.LoadUint64(&m.blockedSends),
+		BlockedMS:    float64(atomic.LoadInt64(&m.blockedNanos)) / 1e6,
+		DispatchNum:  atomic.LoadUint64(&m.dispatchNum),
+	}
+	m.mu.Lock()
+	if m.samples > 0 {
+		h.AvgResultsOccupancy = m.occupancySum / float64(m.samples)
+	}
+	h.MaxResultsOccupancy = m.maxOccupancy
+	h.MaxGoroutines = m.maxGoroutines
+	start, startCPU, startGC := m.start, m.startCPU, m.startGC
+	m.mu.Unlock()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	h.GCNum = ms.NumGC - startGC.NumGC
+	h.GCPauseMS = float64(ms.PauseTotalNs-startGC.PauseTotalNs) / 1e6
+	wall := time.Since(start)
+	if wall > 0 {
+		h.CPUUsage = float64(processCPUTime()-startCPU) / float64(wall) / float64(runtime.NumCPU())
+	}
+	if h.DispatchNum > 0 {
+		h.AvgDispatchLagMS = float64(atomic.LoadInt64(&m.dispatchLagNanos)) / float64(h.DispatchNum) / 1e6
+	}
+	h.MaxDispatchLagMS = float64(atomic.LoadInt64(&m.maxDispatchLag)) / 1e6
+	h.Warnings = h.diagnose(wall)
+	return h
+}
+
+func (h *GeneratorHealth) diagnose(wall time.Duration) []string {
+	var warnings []string
+	wallMS := float64(wall) / 1e6
+	if h.BlockedSends > 0 {
+		warnings = append(warnings, fmt.Sprintf("结果通道已满, %d次发送共阻塞%.2fms, 阻塞时间会计入后续请求耗时, 请调大ResultsBufferSize",
+			h.BlockedSends, h.BlockedMS))
+	} else if h.MaxResultsOccupancy >= 0.9 {
+		warnings = append(warnings, fmt.Sprintf("结果通道占用率最高达%.0f%%, 统计协程处理不及时", h.MaxResultsOccupancy*100))
+	}
+	if h.CPUUsage >= 0.9 {
+		warnings = append(warnings, fmt.Sprintf("压测进程cpu占用率%.0f%%, 结果可能受压测端自身限制", h.CPUUsage*100))
+	}
+	if wallMS > 0 && h.GCPauseMS/wallMS >= 0.01 {
+		warnings = append(warnings, fmt.Sprintf("gc暂停共%.2fms, 占运行时间%.1f%%", h.GCPauseMS, h.GCPauseMS/wallMS*100))
+	}
+	if h.AvgDispatchLagMS >= 1 || h.MaxDispatchLagMS >= 100 {
+		warnings = append(warnings, fmt.Sprintf("请求发起延迟 avg %.3fms max %.3fms, 调度跟不上计划(开环压测时可能是ConcurrencyNum不足)", h.AvgDispatchLagMS, h.MaxDispatchLagMS))
+	}
+	return warnings
+}
@@ -0,0 +1,293 @@
+package kite
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	chartWidth   = 720
+	chartHeight  = 240
+	chartPadding = 48
+)
+
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd"}
+
+// 折线图中的一条曲线
+type chartSeries struct {
+	name   string
+	xs, ys []float64
+}
+
+func chartBounds(series []chartSeries) (maxX, maxY float64) {
+	for _, sr := range series {
+		for i := range sr.xs {
+			maxX = math.Max(maxX, sr.xs[i])
+			maxY = math.Max(maxY, sr.ys[i])
+		}
+	}
+	if maxX == 0 {
+		maxX = 1
+	}
+	if maxY == 0 {
+		maxY = 1
+	}
+	return maxX, maxY * 1.1
+}
+
+// 坐标轴, 刻度及图例
+func chartAxes(b *strings.Builder, maxX, maxY float64, xLabel, yLabel string, names []string) {
+	x0, y0 := float64(chartPadding), float64(chartHeight-chartPadding)
+	fmt.Fprintf(b, `<line x1="%.0f" y1="%.0f" x2="%d" y2="%.0f" stroke="#333"/>`, x0, y0, chartWidth-chartPadding/2, y0)
+	fmt.Fprintf(b, `<line x1="%.0f" y1="%d" x2="%.0f" y2="%.0f" stroke="#333"/>`, x0, chartPadding/2, x0, y0)
+	for i := 0; i <= 4; i++ {
+		y := y0 - (y0-chartPadding/2)*float64(i)/4
+		fmt.Fprintf(b, `<line x1="%.0f" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, x0, y, chartWidth-chartPadding/2, y)
+		fmt.Fprintf(b, `<text x="%.0f" y="%.1f" font-size="10" text-anchor="end">%.4g</text>`, x0-4, y+3, maxY*float64(i)/4)
+		if maxX == 0 {
+			continue
+		}
+		x := x0 + (chartWidth-chartPadding*1.5)*float64(i)/4
+		fmt.Fprintf(b, `<text x="%.1f" y="%.0f" font-size="10" text-anchor="middle">%.4g</text>`, x, y0+14, maxX*float64(i)/4)
+	}
+	fmt.Fprintf(b, `<text x="%d" y="%d" font-size="11" text-anchor="middle">%s</text>`, chartWidth/2, chartHeight-8, template.HTMLEscapeString(xLabel))
+	fmt.Fprintf(b, `<text x="12" y="%d" font-size="11" transform="rotate(-90 12 %d)" text-anchor="middle">%s</text>`,
+		chartHeight/2, chartHeight/2, template.HTMLEscapeString(yLabel))
+	for i, name := range names {
+		x := chartPadding + 110*i
+		fmt.Fprintf(b, `<rect x="%d" y="4" width="10" height="10" fill="%s"/>`, x, chartColors[i%len(chartColors)])
+		fmt.Fprintf(b, `<text x="%d" y="13" font-size="11">%s</text>`, x+14, template.HTMLEscapeString(name))
+	}
+}
+
+func chartPoint(x, y, maxX, maxY float64) (float64, float64) {
+	px := chartPadding + (chartWidth-chartPadding*1.5)*x/maxX
+	py := float64(chartHeight-chartPadding) - float64(chartHeight-chartPadding*1.5)*y/maxY
+	return px, py
+}
+
+// 生成svg折线图
+func svgLineChart(series []chartSeries, xLabel, yLabel string) template.HTML {
+	var b strings.Builder
+	maxX, maxY := chartBounds(series)
+	names := make([]string, len(series))
+	for i, sr := range series {
+		names[i] = sr.name
+	}
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, chartWidth, chartHeight)
+	chartAxes(&b, maxX, maxY, xLabel, yLabel, names)
+	for i, sr := range series {
+		points := make([]string, len(sr.xs))
+		for j := range sr.xs {
+			px, py := chartPoint(sr.xs[j], sr.ys[j], maxX, maxY)
+			points[j] = fmt.Sprintf("%.1f,%.1f", px, py)
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke-width="1.5" stroke="%s" points="%s"/>`,
+			chartColors[i%len(chartColors)], strings.Join(points, " "))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// 生成svg柱状图
+func svgBarChart(labels []string, values []float64, xLabel, yLabel string) template.HTML {
+	var b strings.Builder
+	maxY := float64(0)
+	for _, v := range values {
+		maxY = math.Max(maxY, v)
+	}
+	if maxY == 0 {
+		maxY = 1
+	}
+	maxY *= 1.1
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, chartWidth, chartHeight)
+	chartAxes(&b, 0, maxY, xLabel, yLabel, nil)
+	if len(values) > 0 {
+		w := (chartWidth - chartPadding*1.5) / float64(len(values))
+		for i, v := range values {
+			x := chartPadding + w*float64(i)
+			_, y := chartPoint(0, v, 1, maxY)
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %.0f</title></rect>`,
+				x+1, y, w-2, float64(chartHeight-chartPadding)-y, chartColors[0], template.HTMLEscapeString(labels[i]), v)
+			if len(values) <= 20 {
+				fmt.Fprintf(&b, `<text x="%.1f" y="%d" font-size="9" text-anchor="middle">%s</text>`,
+					x+w/2, chartHeight-chartPadding+26, template.HTMLEscapeString(labels[i]))
+			}
+		}
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// html报告中单个Header的内容
+type htmlSection struct {
+	*Report
+	LoadBytes   string
+	LoadSpeed   string
+	UploadBytes string
+	UploadSpeed string
+	Latency     template.HTML
+	Throughput  template.HTML
+	Histogram   template.HTML
+	Percentiles template.HTML
+}
+
+func newHTMLSection(r *Report) *htmlSection {
+	sec := &htmlSection{
+		Report:      r,
+		LoadBytes:   fmt.Sprintf("%dB", r.LoadBytes),
+		LoadSpeed:   fmt.Sprintf("%dB/s", r.LoadSpeed),
+		UploadBytes: fmt.Sprintf("%dB", r.UploadBytes),
+		UploadSpeed: fmt.Sprintf("%dB/s", r.UploadSpeed),
+	}
+	var offsets, avg, p50, p99, max, qps, failures []float64
+	for _, p := range r.Timeline {
+		offsets = append(offsets, p.OffsetSec)
+		avg = append(avg, p.AvgLatencyMS)
+		p50 = append(p50, p.P50LatencyMS)
+		p99 = append(p99, p.P99LatencyMS)
+		max = append(max, p.MaxLatencyMS)
+		qps = append(qps, p.QPS)
+		failures = append(failures, float64(p.FailureNum))
+	}
+	sec.Latency = svgLineChart([]chartSeries{
+		{"avg", offsets, avg},
+		{"p50", offsets, p50},
+		{"p99", offsets, p99},
+		{"max", offsets, max},
+	}, "elapsed (s)", "latency (ms)")
+	sec.Throughput = svgLineChart([]chartSeries{
+		{"qps", offsets, qps},
+		{"errors", offsets, failures},
+	}, "elapsed (s)", "per interval")
+	histogram := r.GenerateHistogram()
+	labels := make([]string, len(histogram))
+	counts := make([]float64, len(histogram))
+	for i, h := range histogram {
+		labels[i] = fmt.Sprintf("%.2f", h.Mark)
+		counts[i] = float64(h.Count)
+	}
+	sec.Histogram = svgBarChart(labels, counts, "latency (ms)", "count")
+	var pctls, latencies []float64
+	for _, d := range r.GenerateDistribution() {
+		pctls = append(pctls, d.Percentile)
+		latencies = append(latencies, d.Latency)
+	}
+	sec.Percentiles = svgLineChart([]chartSeries{{"latency", pctls, latencies}}, "percentile (%)", "latency (ms)")
+	return sec
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pct": func(v float64) float64 { return v * 100 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Kite Report</title>
+<style>
+body { font-family: sans-serif; margin: 24px; color: #222; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th { background: #f4f4f4; }
+td.name { text-align: left; }
+h2 { border-bottom: 1px solid #ccc; padding-bottom: 4px; }
+.warning { color: #d62728; font-weight: bold; }
+.charts svg { margin: 0 16px 16px 0; border: 1px solid #eee; }
+</style>
+</head>
+<body>
+<h1>Kite Report</h1>
+{{with .Health}}<h2>Generator health</h2>
+<table>
+<tr><th>结果通道占用</th><th>阻塞发送</th><th>goroutine</th><th>gc</th><th>cpu</th><th>发起延迟</th></tr>
+<tr><td>max {{printf "%.0f" (pct .MaxResultsOccupancy)}}% avg {{printf "%.0f" (pct .AvgResultsOccupancy)}}% (cap {{.ResultsCap}})</td><td>{{.BlockedSends}}次 {{printf "%.2f" .BlockedMS}}ms</td><td>max {{.MaxGoroutines}}</td><td>{{.GCNum}}次 {{printf "%.2f" .GCPauseMS}}ms</td><td>{{printf "%.0f" (pct .CPUUsage)}}%</td><td>avg {{printf "%.3f" .AvgDispatchLagMS}}ms max {{printf "%.3f" .MaxDispatchLagMS}}ms</td></tr>
+</table>
+{{range .Warnings}}<p class="warning">WARNING: {{.}}</p>
+{{end}}{{end}}
+{{with .Retry}}<h2>Requests</h2>
+<table>
+<tr><th>请求数</th><th>首次成功</th><th>首次失败</th><th>重试次数</th><th>最终成功</th><th>最终失败</th></tr>
+<tr><td>{{.Requests}}</td><td>{{.FirstSuccess}}</td><td>{{.FirstFailure}}</td><td>{{.Retries}}</td><td>{{.FinalSuccess}}</td><td>{{.FinalFailure}}</td></tr>
+</table>
+{{end}}{{with .Pacing}}<h2>Pacing</h2>
+<table>
+<tr><th>固定间隔</th><th>迭代数</th><th>平均等待</th><th>超时迭代</th><th>最大超出</th></tr>
+<tr><td>{{if .PacingMS}}{{.PacingMS}}ms{{else}}-{{end}}</td><td>{{.Iterations}}</td><td>{{printf "%.2fms" .AvgWaitMS}}</td><td>{{.Overruns}}</td><td>{{printf "%.2fms" .MaxOverrunMS}}</td></tr>
+</table>
+{{with .Warning}}<p class="warning">WARNING: {{.}}</p>
+{{end}}{{end}}<table>
+<tr><th>消息类型</th><th>命令字</th><th>耗时</th><th>并发数</th><th>成功数</th><th>失败数</th><th>qps</th><th>最长耗时</th><th>最短耗时</th><th>平均耗时</th><th>下载字节</th><th>字节每秒</th><th>上传字节</th><th>字节每秒</th><th>错误码</th></tr>
+{{range .Sections}}<tr><td class="name">{{.MsgType}}</td><td class="name">{{.Method}}{{with .Tags}}<br>{{.}}{{end}}</td><td>{{printf "%.0fs" .TotalUseSec}}</td><td>{{.ConcyNum}}</td><td>{{.SuccessNum}}</td><td>{{.FailureNum}}</td><td>{{printf "%.2f" .QPS}}</td><td>{{printf "%.2fms" .MaxLatencyMS}}</td><td>{{printf "%.2fms" .MinLatencyMS}}</td><td>{{printf "%.2fms" .AvgLatencyMS}}</td><td>{{.LoadBytes}}</td><td>{{.LoadSpeed}}</td><td>{{.UploadBytes}}</td><td>{{.UploadSpeed}}</td><td class="name">{{.Errors.Format .MsgType}}</td></tr>
+{{end}}</table>
+{{range .Sections}}
+<h2>{{.Title}}</h2>
+{{if .WarmupNum}}<p>预热{{printf "%.1f" .WarmupSec}}s, 排除{{.WarmupNum}}条结果(失败{{.WarmupFailNum}}), 统计仅含稳定阶段</p>
+{{end}}{{with .Checks}}<table>
+<tr><th>检查</th><th>通过</th><th>失败</th><th>通过率</th></tr>
+{{range .}}<tr><td class="name">{{.Name}}</td><td>{{.Passed}}</td><td>{{.Failed}}</td><td>{{printf "%.2f%%" .PassRate}}</td></tr>
+{{end}}</table>
+{{end}}{{with .ErrSamples}}<table>
+<tr><th>错误码</th><th>次数</th><th>首次出现</th><th>最近出现</th><th>错误信息</th></tr>
+{{range .}}<tr><td>{{.ErrCode}}{{with .Name}} {{.}}{{end}}</td><td>{{.Count}}</td><td>{{.FirstSeen.Format "15:04:05.000"}}</td><td>{{.LastSeen.Format "15:04:05.000"}}</td><td class="name">{{.Message}}</td></tr>
+{{end}}</table>
+{{end}}<div class="charts">
+{{.Latency}}
+{{.Throughput}}
+{{.Histogram}}
+{{.Percentiles}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// 输出不依赖外部资源的html报告
+func WriteHTMLReport(w io.Writer, reports []*Report) error {
+	sorted := make([]*Report, len(reports))
+	copy(sorted, reports)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].MsgType != sorted[j].MsgType {
+			return sorted[i].MsgType < sorted[j].MsgType
+		}
+		if sorted[i].Method != sorted[j].Method {
+			return sorted[i].Method < sorted[j].Method
+		}
+		return sorted[i].Tags < sorted[j].Tags
+	})
+	data := struct {
+		Health   *GeneratorHealth
+		Retry    *RetryStats
+		Pacing   *PacingStats
+		Sections []*htmlSection
+	}{Sections: make([]*htmlSection, len(sorted))}
+	for i, r := range sorted {
+		data.Sections[i] = newHTMLSection(r)
+		if r.Health != nil {
+			data.Health = r.Health
+		}
+		if r.Retry != nil {
+			data.Retry = r.Retry
+		}
+		if r.Pacing != nil {
+			data.Pacing = r.Pacing
+		}
+	}
+	return htmlReportTemplate.Execute(w, data)
+}
+
+func WriteHTMLReportFile(path string, reports []*Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = WriteHTMLReport(f, reports)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package kite
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// http场景中的一个请求
+type HTTPStep struct {
+	Name   string // 步骤名, 非空时写入结果的Step
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+	Delay  time.Duration // 录制时距上一个请求开始的间隔
+	Checks []Check       // 该请求额外的响应检查
+	// 从该请求的响应中提取变量, 之后的请求可在URL, 请求头及请求体中以${name}引用
+	Extract []Extractor
+}
+
+// 按顺序执行的一组http请求, 每次迭代完整执行一遍
+type HTTPScenario struct {
+	Steps []*HTTPStep
+}
+
+// 场景的回放节奏
+type ReplayMode int
+
+const (
+	ReplayFullSpeed ReplayMode = iota // 上一个请求完成后立即发起下一个
+	ReplayOriginal                    // 按录制时的间隔发起, 上一个请求耗时超出间隔时立即发起
+)
+
+type HTTPHandlerConfig struct {
+	Scenario *HTTPScenario
+	Replay   ReplayMode
+	// 底层传输, 默认每个worker克隆一份http.DefaultTransport, 各自维持连接
+	NewTransport func() http.RoundTripper
+	// 非空时设置到默认底层传输, 用于客户端证书(mTLS)及自定义CA; 自定义NewTransport时需自行设置
+	TLS *tls.Config
+	// 非空时为每个请求附加Authorization头, 获取token的耗时以消息类型auth单独统计
+	Auth AuthProvider
+	// 同HTTPClientInterceptor的filter
+	Filter func(result *Response, req *http.Request, rsp *http.Response, err error)
+	// 对每个响应执行的检查, 结果计入Report.Checks
+	Checks []Check
+	// 检查不通过时将请求记为失败(ERR_CODE_CHECK), 否则只计入检查统计
+	FailOnCheck bool
+}
+
+type httpHandler struct {
+	cfg    *HTTPHandlerConfig
+	client *http.Client
+	target *url.URL
+	vars   *Vars // 该虚拟用户的变量, 跨迭代保留
+}
+
+// 内置http场景handler, 每次OnRequest依次执行场景中的请求, 传输错误时中止本次迭代
+// Request.Url非空时以其scheme及host替换各请求的url, 便于将录制的场景回放到其他环境
+func NewHTTPHandler(cfg *HTTPHandlerConfig) NewReqHandlerFunc {
+	if cfg.NewTransport == nil {
+		cfg.NewTransport = func() http.RoundTripper {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			if cfg.TLS != nil {
+				t.TLSClientConfig = cfg.TLS.Clone()
+			}
+			return t
+		}
+	}
+	return func() ReqHandler {
+		return &httpHandler{cfg: cfg}
+	}
+}
+
+func (h *httpHandler) Init(req *Request, results chan<- *Response) error {
+	if req.Url != "" {
+		u, err := url.Parse(req.Url)
+		if err != nil {
+			return err
+		}
+		h.target = u
+	}
+	h.vars = NewVars()
+	var rt http.RoundTripper = HTTPClientInterceptor(results, h.cfg.NewTransport(), HTTPCheckFilter(h.cfg.Checks, h.cfg.FailOnCheck, h.cfg.Filter))
+	if h.cfg.Auth != nil {
+		rt = HTTPAuthTransport(h.cfg.Auth, results, rt)
+	}
+	h.client = &http.Client{
+		Transport: rt,
+		// 重定向由场景中录制的后续请求体现, 不自动跟随
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+func (h *httpHandler) OnRequest() error {
+	return h.OnRequestContext(context.Background())
+}
+
+func (h *httpHandler) OnRequestContext(ctx context.Context) error {
+	var last time.Time
+	for i, step := range h.cfg.Scenario.Steps {
+		if h.cfg.Replay == ReplayOriginal && i > 0 {
+			if wait := time.Until(last.Add(step.Delay)); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		last = time.Now()
+		if err := h.do(ctx, step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *httpHandler) do(ctx context.Context, step *HTTPStep) error {
+	if step.Name != "" {
+		ctx = WithStep(ctx, step.Name)
+	}
+	ctx = WithChecks(ctx, step.Checks...)
+	ctx = WithExtractors(ctx, h.vars, step.Extract...)
+	body := step.Body
+	if bytes.Contains(body, []byte("${")) {
+		body = []byte(h.vars.Expand(string(body)))
+	}
+	req, err := http.NewRequest(step.Method, h.vars.Expand(step.URL), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	if h.target != nil {
+		req.URL.Scheme = h.target.Scheme
+		req.URL.Host = h.target.Host
+		req.Host = ""
+	}
+	for k, vs := range step.Header {
+		// 与LoadHAR/ParseCurl一致按规范化的名称设置, 手写的小写名称(如host)也能被识别
+		expanded := make([]string, len(vs))
+		for i, v := range vs {
+			expanded[i] = h.vars.Expand(v)
+		}
+		req.Header[http.CanonicalHeaderKey(k)] = expanded
+	}
+	if host := req.Header.Get("Host"); host != "" && h.target == nil {
+		req.Host = host
+	}
+	req.Header.Del("Host")
+	rsp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func (h *httpHandler) Close() {
+	h.client.CloseIdleConnections()
+}
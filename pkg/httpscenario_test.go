@@ -0,0 +1,51 @@
+package kite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 提取的变量在后续请求中展开, 小写的请求头名称(含host)同样生效
+func TestHTTPScenarioHeaders(t *testing.T) {
+	type seen struct{ host, auth string }
+	got := make(chan seen, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.Write([]byte(`{"token": "t1"}`))
+			return
+		}
+		got <- seen{r.Host, r.Header.Get("Authorization")}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name   string
+		header http.Header
+		want   seen
+	}{
+		{"canonical", http.Header{"Host": {"svc.internal"}, "Authorization": {"Bearer ${token}"}}, seen{"svc.internal", "Bearer t1"}},
+		{"lowercase", http.Header{"host": {"svc.internal"}, "authorization": {"Bearer ${token}"}}, seen{"svc.internal", "Bearer t1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			extract, _ := ParseExtractor("token=json:token")
+			scenario := &HTTPScenario{Steps: []*HTTPStep{
+				{Method: "POST", URL: srv.URL + "/login", Extract: []Extractor{extract}},
+				{Method: "GET", URL: srv.URL + "/api", Header: c.header},
+			}}
+			cfg := &Config{ConcurrencyNum: 1, ReqNumPerConcy: 1, ResultsBufferSize: 16}
+			if _, err := quietServer().Run(cfg, &Request{}, NewHTTPHandler(&HTTPHandlerConfig{Scenario: scenario})); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			select {
+			case s := <-got:
+				if s != c.want {
+					t.Errorf("server saw %+v, want %+v", s, c.want)
+				}
+			default:
+				t.Fatal("api request not sent")
+			}
+		})
+	}
+}
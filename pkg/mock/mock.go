@@ -0,0 +1,223 @@
+// 可配置的模拟压测目标, 用于校准kite自身开销及构造确定性的统计场景
+package mock
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kite "github.com/xingshuo/kite/pkg"
+	pb "github.com/xingshuo/kite/pkg/mock/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 模拟目标的行为配置
+type Profile struct {
+	Latency      kite.Distribution // 响应延迟, nil表示不额外延迟
+	ErrorRates   map[int]float64   // 错误码=>注入概率, http为状态码, grpc为codes.Code
+	ResponseSize int               // 响应体字节数
+	BandwidthBPS int64             // 单个响应的发送带宽 bytes/second, 0表示不限
+	Seed         int64             // 随机种子, 相同种子产生相同的采样序列
+}
+
+// 按Profile采样延迟和错误
+type target struct {
+	profile *Profile
+	mu      sync.Mutex
+	rand    *rand.Rand
+	codes   []int // 按错误码排序, 保证相同种子结果稳定
+	body    []byte
+}
+
+func newTarget(p *Profile) *target {
+	t := &target{
+		profile: p,
+		rand:    rand.New(rand.NewSource(p.Seed)),
+		body:    []byte(strings.Repeat("k", p.ResponseSize)),
+	}
+	for code := range p.ErrorRates {
+		t.codes = append(t.codes, code)
+	}
+	sort.Ints(t.codes)
+	return t
+}
+
+// 采样本次请求的延迟及注入的错误码, ok为false表示不注入错误
+func (t *target) sample() (delay time.Duration, code int, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.profile.Latency != nil {
+		delay = t.profile.Latency.Sample(t.rand)
+	}
+	v := t.rand.Float64()
+	for _, c := range t.codes {
+		v -= t.profile.ErrorRates[c]
+		if v < 0 {
+			return delay, c, true
+		}
+	}
+	return delay, 0, false
+}
+
+// 按带宽限制写出响应体
+func (t *target) write(w io.Writer) error {
+	bps := t.profile.BandwidthBPS
+	if bps <= 0 {
+		_, err := w.Write(t.body)
+		return err
+	}
+	chunk := int(bps / 100) // 每10ms一块
+	if chunk <= 0 {
+		chunk = 1
+	}
+	for off := 0; off < len(t.body); off += chunk {
+		end := off + chunk
+		if end > len(t.body) {
+			end = len(t.body)
+		}
+		if _, err := w.Write(t.body[off:end]); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		time.Sleep(time.Duration(int64(end-off) * int64(time.Second) / bps))
+	}
+	return nil
+}
+
+func NewHTTPHandler(p *Profile) http.Handler {
+	t := newTarget(p)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		delay, code, ok := t.sample()
+		time.Sleep(delay)
+		if ok {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(t.body)))
+		w.WriteHeader(http.StatusOK)
+		t.write(w)
+	})
+}
+
+// 模拟OAuth2 client credentials的token端点, 用于验证token获取及刷新
+type TokenIssuer struct {
+	ClientID     string // 为空时不校验客户端
+	ClientSecret string
+	TTL          time.Duration // token有效期, 默认1小时
+
+	mu     sync.Mutex
+	seq    int
+	tokens map[string]time.Time
+}
+
+func (ti *TokenIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.FormValue("grant_type") != "client_credentials" {
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if ti.ClientID != "" && (id != ti.ClientID || secret != ti.ClientSecret) {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	ttl := ti.TTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	ti.mu.Lock()
+	ti.seq++
+	token := fmt.Sprintf("mock-token-%d", ti.seq)
+	if ti.tokens == nil {
+		ti.tokens = make(map[string]time.Time)
+	}
+	ti.tokens[token] = time.Now().Add(ttl)
+	ti.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":%d}`, token, int64(ttl/time.Second))
+}
+
+// 已签发的token数
+func (ti *TokenIssuer) Issued() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.seq
+}
+
+// 校验Authorization头中的bearer token, 未签发或已过期时返回401
+func (ti *TokenIssuer) RequireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		ti.mu.Lock()
+		expires, ok := ti.tokens[token]
+		ti.mu.Unlock()
+		if !ok || time.Now().After(expires) {
+			io.Copy(ioutil.Discard, r.Body)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type greeterServer struct {
+	t *target
+}
+
+func NewGreeterServer(p *Profile) pb.GreeterServer {
+	return &greeterServer{t: newTarget(p)}
+}
+
+func (s *greeterServer) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	delay, code, ok := s.t.sample()
+	if bps := s.t.profile.BandwidthBPS; bps > 0 {
+		delay += time.Duration(int64(len(s.t.body)) * int64(time.Second) / bps)
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if ok {
+		return nil, status.Error(codes.Code(code), "mock injected error")
+	}
+	return &pb.HelloReply{Message: string(s.t.body)}, nil
+}
+
+// 解析错误注入配置, 格式: 500:0.01,503:0.005
+func ParseErrorRates(spec string) (map[int]float64, error) {
+	rates := make(map[int]float64)
+	if spec == "" {
+		return rates, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid error rate %q", item)
+		}
+		code, err := strconv.Atoi(kv[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid error rate %q: %v", item, err)
+		}
+		rate, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error rate %q: %v", item, err)
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
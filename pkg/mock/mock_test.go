@@ -0,0 +1,100 @@
+package mock_test
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kite "github.com/xingshuo/kite/pkg"
+	"github.com/xingshuo/kite/pkg/mock"
+)
+
+// 固定种子下模拟目标注入错误的序列是确定的, 单worker顺序执行时可精确推算统计结果
+func TestSeededMockStatistics(t *testing.T) {
+	const (
+		seed     = 7
+		requests = 60
+		errRate  = 0.25
+		latency  = 5 * time.Millisecond
+	)
+	srv := httptest.NewServer(mock.NewHTTPHandler(&mock.Profile{
+		Latency:    kite.FixedDist{Value: latency},
+		ErrorRates: map[int]float64{503: errRate},
+		Seed:       seed,
+	}))
+	defer srv.Close()
+
+	// 按相同种子推算: 每次尝试采样一次, 失败后重试一次
+	r := rand.New(rand.NewSource(seed))
+	var success, failure, retries, finalFailure int
+	for i := 0; i < requests; i++ {
+		for attempt := 1; attempt <= 2; attempt++ {
+			if r.Float64() >= errRate {
+				success++
+				break
+			}
+			failure++
+			if attempt == 1 {
+				retries++
+			} else {
+				finalFailure++
+			}
+		}
+	}
+
+	cfg := &kite.Config{
+		ConcurrencyNum:    1,
+		ReqNumPerConcy:    requests,
+		ResultsBufferSize: 1024,
+		Arrival:           kite.ConstantArrival{Rate: 100},
+		Retry:             &kite.RetryPolicy{MaxAttempts: 2},
+		Percentiles:       []float64{50, 99},
+	}
+	handler := kite.NewHTTPHandler(&kite.HTTPHandlerConfig{
+		Scenario:    &kite.HTTPScenario{Steps: []*kite.HTTPStep{{Method: "GET", URL: srv.URL + "/hello"}}},
+		Checks:      []kite.Check{kite.StatusIn{200}},
+		FailOnCheck: true,
+	})
+	s := kite.NewServer()
+	s.RedirectLog(func(format string, a ...interface{}) (int, error) { return 0, nil })
+	reports, err := s.Run(cfg, &kite.Request{}, handler)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var report *kite.Report
+	for _, rep := range reports {
+		if rep.MsgType == kite.MSG_HTTP {
+			report = rep
+		}
+	}
+	if report == nil {
+		t.Fatal("no http report")
+	}
+	if int(report.SuccessNum) != success || int(report.FailureNum) != failure {
+		t.Errorf("success/failure = %d/%d, want %d/%d", report.SuccessNum, report.FailureNum, success, failure)
+	}
+	if report.Errors[200] != success || report.Errors[kite.ERR_CODE_CHECK] != failure {
+		t.Errorf("errors = %v, want 200:%d -1005:%d", report.Errors, success, failure)
+	}
+	if len(report.Checks) != 1 || int(report.Checks[0].Passed) != success || int(report.Checks[0].Failed) != failure {
+		t.Errorf("checks = %+v, want passed %d failed %d", report.Checks, success, failure)
+	}
+	if st := report.Retry; st == nil || st.Requests != requests || int(st.Retries) != retries || int(st.FinalFailure) != finalFailure {
+		t.Errorf("retry = %+v, want requests %d retries %d final failure %d", st, requests, retries, finalFailure)
+	}
+	if len(report.Latencies) != success+failure {
+		t.Errorf("latencies = %d, want %d", len(report.Latencies), success+failure)
+	}
+	// 延迟至少为注入的固定延迟, 本机回环的额外开销远小于100ms
+	minMS := float64(latency) / 1e6
+	for _, d := range report.GenerateDistribution() {
+		if d.Latency < minMS || d.Latency > minMS+100 {
+			t.Errorf("p%v = %.2fms, want in [%.0f, %.0f]ms", d.Percentile, d.Latency, minMS, minMS+100)
+		}
+	}
+	if report.MinLatencyMS < minMS {
+		t.Errorf("min latency %.2fms < %.0fms", report.MinLatencyMS, minMS)
+	}
+}
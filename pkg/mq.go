@@ -0,0 +1,426 @@
+package kite
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 消息头: 发送时间戳(纳秒) + 生产者id + 序号
+const mqHeaderLen = 24
+
+var ErrBrokerClosed = errors.New("kite: broker closed")
+
+// 消息队列适配接口, 内置MemoryHub及NATSBroker, 其他消息队列(如Kafka, RabbitMQ)需基于其客户端实现
+type Broker interface {
+	// 发布消息, 消息交给broker后返回; broker确认后回调onAck, Close返回后不再回调
+	// Close应先等待已发布消息的确认(可设超时), 否则未确认的消息会被计为确认失败
+	Publish(topic string, payload []byte, onAck func(err error)) error
+	// 以消费组group订阅topic, 同组的消费者分摊消息
+	Subscribe(topic, group string, fn func(payload []byte)) error
+	Close() error
+}
+
+type NewBrokerFunc func() (Broker, error)
+
+type MQConfig struct {
+	NewBroker      NewBrokerFunc // 每个生产者及消费者独立创建连接
+	Topic          string
+	Group          string // 消费组, 默认为kite
+	PayloadSize    int    // 消息大小, 不足消息头长度时按消息头长度
+	ConsumerNum    int    // 消费者数, 默认为1
+	DrainTimeoutMS int    // 生产结束后等待消费完成的最长时间, 默认5000
+}
+
+// 消息队列压测的汇总数据
+type MQStats struct {
+	Published  uint64 // 发布成功数
+	Acked      uint64 // broker确认数
+	Delivered  uint64 // 消费数(去重后)
+	Duplicated uint64 // 重复消费数
+	Lost       uint64 // 已确认但直到结束仍未被消费的消息数
+	MaxLag     uint64 // 最大消费滞后(已确认未消费的消息数)
+}
+
+func (st *MQStats) Output(logfn LogFunc, topic string) {
+	logfn("MQ summary: topic %s | 发布 %d | 确认 %d | 消费 %d | 重复 %d | 丢失 %d | 最大消费滞后 %d\n",
+		topic, st.Published, st.Acked, st.Delivered, st.Duplicated, st.Lost, st.MaxLag)
+}
+
+// 单个生产者已消费的序号集合
+type seqSet []uint64
+
+// 标记序号, 返回之前是否已标记
+func (s *seqSet) testAndSet(seq uint64) bool {
+	idx := int(seq / 64)
+	for len(*s) <= idx {
+		*s = append(*s, 0)
+	}
+	bit := uint64(1) << (seq % 64)
+	if (*s)[idx]&bit != 0 {
+		return true
+	}
+	(*s)[idx] |= bit
+	return false
+}
+
+// 生产者/消费者模式的消息队列压测
+// 生产者作为ReqHandler由Server驱动, 消费者在运行期间独立消费并上报端到端延迟
+type MQTest struct {
+	cfg        *MQConfig
+	producerID uint64
+
+	mu        sync.Mutex
+	results   chan<- *Response
+	closing   bool
+	consumers []Broker
+	received  map[uint64]*seqSet
+
+	published  uint64
+	acked      uint64
+	delivered  uint64
+	duplicated uint64
+	maxLag     uint64
+}
+
+func NewMQTest(cfg *MQConfig) *MQTest {
+	if cfg.Group == "" {
+		cfg.Group = "kite"
+	}
+	if cfg.ConsumerNum <= 0 {
+		cfg.ConsumerNum = 1
+	}
+	if cfg.DrainTimeoutMS <= 0 {
+		cfg.DrainTimeoutMS = 5000
+	}
+	if cfg.PayloadSize < mqHeaderLen {
+		cfg.PayloadSize = mqHeaderLen
+	}
+	return &MQTest{
+		cfg:      cfg,
+		received: make(map[uint64]*seqSet),
+	}
+}
+
+// 作为NewReqHandlerFunc传给Server
+func (t *MQTest) NewProducer() ReqHandler {
+	return &mqProducer{t: t}
+}
+
+// 启动消费者并运行压测, 生产结束后等待消费完成再统计丢失
+func (t *MQTest) Run(s *Server, cfg *Config) ([]*Report, *MQStats, error) {
+	for i := 0; i < t.cfg.ConsumerNum; i++ {
+		b, err := t.cfg.NewBroker()
+		if err == nil {
+			err = b.Subscribe(t.cfg.Topic, t.cfg.Group, t.onMessage)
+		}
+		if err != nil {
+			t.closeConsumers()
+			return nil, nil, err
+		}
+		t.consumers = append(t.consumers, b)
+	}
+	stopLag := make(chan struct{})
+	go t.sampleLag(stopLag)
+	c := *cfg
+	c.OnWorkersDone = func(results chan<- *Response) {
+		t.drain(results)
+		if cfg.OnWorkersDone != nil {
+			cfg.OnWorkersDone(results)
+		}
+	}
+	reports, err := s.Run(&c, &Request{Url: t.cfg.Topic}, t.NewProducer)
+	close(stopLag)
+	t.closeConsumers()
+	stats := t.Stats()
+	stats.Output(s.logfn, t.cfg.Topic)
+	return reports, stats, err
+}
+
+func (t *MQTest) Stats() *MQStats {
+	st := &MQStats{
+		Published:  atomic.LoadUint64(&t.published),
+		Acked:      atomic.LoadUint64(&t.acked),
+		Delivered:  atomic.LoadUint64(&t.delivered),
+		Duplicated: atomic.LoadUint64(&t.duplicated),
+		MaxLag:     atomic.LoadUint64(&t.maxLag),
+	}
+	// 未确认的消息也可能被消费, 这里只统计确认数超出消费数的部分
+	if st.Acked > st.Delivered {
+		st.Lost = st.Acked - st.Delivered
+	}
+	return st
+}
+
+func (t *MQTest) lag() uint64 {
+	acked, delivered := atomic.LoadUint64(&t.acked), atomic.LoadUint64(&t.delivered)
+	if acked > delivered {
+		return acked - delivered
+	}
+	return 0
+}
+
+func (t *MQTest) sampleLag(stop <-chan struct{}) {
+	ticker := time.NewTicker(healthSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if lag := t.lag(); lag > atomic.LoadUint64(&t.maxLag) {
+				atomic.StoreUint64(&t.maxLag, lag)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (t *MQTest) setResults(results chan<- *Response) {
+	t.mu.Lock()
+	t.results = results
+	t.mu.Unlock()
+}
+
+func (t *MQTest) onMessage(payload []byte) {
+	now := time.Now()
+	if len(payload) < mqHeaderLen {
+		return
+	}
+	sendTime := int64(binary.BigEndian.Uint64(payload[0:8]))
+	producer := binary.BigEndian.Uint64(payload[8:16])
+	seq := binary.BigEndian.Uint64(payload[16:24])
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing || t.results == nil {
+		return
+	}
+	set := t.received[producer]
+	if set == nil {
+		set = &seqSet{}
+		t.received[producer] = set
+	}
+	result := &Response{
+		MsgType:       MSG_MQ,
+		Method:        "deliver:" + t.cfg.Topic,
+		UseTime:       uint64(now.UnixNano() - sendTime),
+		IsSucceed:     true,
+		ReceivedBytes: uint64(len(payload)),
+	}
+	if set.testAndSet(seq) {
+		atomic.AddUint64(&t.duplicated, 1)
+		result.IsSucceed = false
+		result.ErrCode = ERR_CODE_MQ_DUP
+	} else {
+		atomic.AddUint64(&t.delivered, 1)
+	}
+	SendResponse(t.results, result)
+}
+
+// 等待消费追上已确认的消息, 超时后剩余的按丢失上报
+func (t *MQTest) drain(results chan<- *Response) {
+	deadline := time.Now().Add(time.Duration(t.cfg.DrainTimeoutMS) * time.Millisecond)
+	for t.lag() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.mu.Lock()
+	t.closing = true
+	t.mu.Unlock()
+	for i := t.lag(); i > 0; i-- {
+		SendResponse(results, &Response{
+			MsgType:   MSG_MQ,
+			Method:    "lost:" + t.cfg.Topic,
+			IsSucceed: false,
+			ErrCode:   ERR_CODE_MQ_LOST,
+		})
+	}
+}
+
+func (t *MQTest) closeConsumers() {
+	for _, b := range t.consumers {
+		b.Close()
+	}
+	t.consumers = nil
+}
+
+type mqProducer struct {
+	t       *MQTest
+	id      uint64
+	seq     uint64
+	broker  Broker
+	results chan<- *Response
+}
+
+func (p *mqProducer) Init(req *Request, results chan<- *Response) error {
+	b, err := p.t.cfg.NewBroker()
+	if err != nil {
+		return err
+	}
+	p.broker = b
+	p.results = results
+	p.id = atomic.AddUint64(&p.t.producerID, 1)
+	p.t.setResults(results)
+	return nil
+}
+
+func (p *mqProducer) OnRequest() error {
+	t := p.t
+	p.seq++
+	payload := make([]byte, t.cfg.PayloadSize)
+	binary.BigEndian.PutUint64(payload[8:16], p.id)
+	binary.BigEndian.PutUint64(payload[16:24], p.seq)
+	startTime := time.Now()
+	binary.BigEndian.PutUint64(payload[0:8], uint64(startTime.UnixNano()))
+	err := p.broker.Publish(t.cfg.Topic, payload, func(err error) {
+		result := &Response{
+			MsgType:   MSG_MQ,
+			Method:    "ack:" + t.cfg.Topic,
+			UseTime:   uint64(time.Since(startTime)),
+			IsSucceed: err == nil,
+		}
+		if err == nil {
+			atomic.AddUint64(&t.acked, 1)
+		} else {
+			result.ErrCode = ERR_CODE_REQUEST
+			result.ErrMsg = err.Error()
+		}
+		SendResponse(p.results, result)
+	})
+	result := &Response{
+		MsgType:   MSG_MQ,
+		Method:    "publish:" + t.cfg.Topic,
+		UseTime:   uint64(time.Since(startTime)),
+		IsSucceed: err == nil,
+		SentBytes: uint64(len(payload)),
+	}
+	if err == nil {
+		atomic.AddUint64(&t.published, 1)
+	} else {
+		result.ErrCode = ERR_CODE_REQUEST
+		result.ErrMsg = err.Error()
+	}
+	SendResponse(p.results, result)
+	return err
+}
+
+func (p *mqProducer) Close() {
+	p.broker.Close()
+}
+
+// 进程内broker, 用于测试及校准, 可按概率模拟丢失和重复投递
+type MemoryHub struct {
+	DropRate float64
+	DupRate  float64
+
+	mu     sync.RWMutex
+	topics map[string]map[string]*memGroup
+}
+
+type memGroup struct {
+	next uint64
+	subs []*memSub
+}
+
+type memSub struct {
+	ch chan []byte
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{topics: make(map[string]map[string]*memGroup)}
+}
+
+// 可直接作为NewBrokerFunc使用
+func (h *MemoryHub) NewBroker() (Broker, error) {
+	return &memoryBroker{hub: h}, nil
+}
+
+type memoryBroker struct {
+	hub    *MemoryHub
+	mu     sync.Mutex
+	closed bool
+	subs   []*memSub
+}
+
+func (b *memoryBroker) Publish(topic string, payload []byte, onAck func(err error)) error {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrBrokerClosed
+	}
+	h := b.hub
+	h.mu.RLock()
+	for _, g := range h.topics[topic] {
+		if len(g.subs) == 0 {
+			continue
+		}
+		sub := g.subs[atomic.AddUint64(&g.next, 1)%uint64(len(g.subs))]
+		if h.DropRate > 0 && rand.Float64() < h.DropRate {
+			continue
+		}
+		sub.ch <- payload
+		if h.DupRate > 0 && rand.Float64() < h.DupRate {
+			sub.ch <- payload
+		}
+	}
+	h.mu.RUnlock()
+	if onAck != nil {
+		onAck(nil)
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(topic, group string, fn func(payload []byte)) error {
+	sub := &memSub{ch: make(chan []byte, 1024)}
+	go func() {
+		for payload := range sub.ch {
+			fn(payload)
+		}
+	}()
+	h := b.hub
+	h.mu.Lock()
+	groups := h.topics[topic]
+	if groups == nil {
+		groups = make(map[string]*memGroup)
+		h.topics[topic] = groups
+	}
+	if groups[group] == nil {
+		groups[group] = &memGroup{}
+	}
+	groups[group].subs = append(groups[group].subs, sub)
+	h.mu.Unlock()
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	subs := b.subs
+	b.mu.Unlock()
+	h := b.hub
+	h.mu.Lock()
+	for _, sub := range subs {
+		for _, groups := range h.topics {
+			for _, g := range groups {
+				for i, s := range g.subs {
+					if s == sub {
+						g.subs = append(g.subs[:i], g.subs[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+		close(sub.ch)
+	}
+	h.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,210 @@
+package kite
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 关闭连接前等待未确认消息的最长时间
+const natsCloseTimeout = 5 * time.Second
+
+// NATS适配, 基于NATS文本协议实现, 只支持core NATS(不含JetStream)
+// core NATS没有发布确认, 这里以PUB之后的PING/PONG作为确认: 收到PONG即表示此前的消息已被服务端处理
+type natsBroker struct {
+	conn   net.Conn
+	wmu    sync.Mutex
+	w      *bufio.Writer
+	mu     sync.Mutex
+	closed bool
+	acks   []func(err error) // 等待PONG的确认回调, 按发送顺序排列
+	ackErr error             // 下一个PONG之前收到的发布错误
+	subs   map[int]func(payload []byte)
+	nextID int
+	done   chan struct{}
+}
+
+// 返回连接addr(host:port)的NewBrokerFunc
+func NATSBroker(addr string) NewBrokerFunc {
+	return func() (Broker, error) {
+		return DialNATS(addr)
+	}
+}
+
+func DialNATS(addr string) (Broker, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return nil, fmt.Errorf("nats handshake failed: %q %v", line, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	b := &natsBroker{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+		subs: make(map[int]func(payload []byte)),
+		done: make(chan struct{}),
+	}
+	if err := b.write("CONNECT {\"verbose\":false,\"pedantic\":false}\r\n", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go b.readLoop(r)
+	return b, nil
+}
+
+func (b *natsBroker) write(cmd string, payload []byte) error {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	b.w.WriteString(cmd)
+	if payload != nil {
+		b.w.Write(payload)
+		b.w.WriteString("\r\n")
+	}
+	return b.w.Flush()
+}
+
+func (b *natsBroker) Publish(topic string, payload []byte, onAck func(err error)) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	b.wmu.Lock()
+	// 确认回调入队与PING写出保持同一顺序
+	if onAck != nil {
+		b.acks = append(b.acks, onAck)
+	}
+	b.mu.Unlock()
+	fmt.Fprintf(b.w, "PUB %s %d\r\n", topic, len(payload))
+	b.w.Write(payload)
+	b.w.WriteString("\r\n")
+	if onAck != nil {
+		b.w.WriteString("PING\r\n")
+	}
+	err := b.w.Flush()
+	b.wmu.Unlock()
+	return err
+}
+
+func (b *natsBroker) Subscribe(topic, group string, fn func(payload []byte)) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	b.nextID++
+	sid := b.nextID
+	b.subs[sid] = fn
+	b.mu.Unlock()
+	return b.write(fmt.Sprintf("SUB %s %s %d\r\n", topic, group, sid), nil)
+}
+
+func (b *natsBroker) readLoop(r *bufio.Reader) {
+	defer close(b.done)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			b.failAcks(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				continue
+			}
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			sid, _ := strconv.Atoi(fields[2])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				b.failAcks(err)
+				return
+			}
+			b.mu.Lock()
+			fn := b.subs[sid]
+			b.mu.Unlock()
+			if fn != nil {
+				fn(payload[:size])
+			}
+		case line == "PING":
+			b.write("PONG\r\n", nil)
+		case line == "PONG":
+			b.mu.Lock()
+			var ack func(err error)
+			if len(b.acks) > 0 {
+				ack, b.acks = b.acks[0], b.acks[1:]
+			}
+			ackErr := b.ackErr
+			b.ackErr = nil
+			b.mu.Unlock()
+			if ack != nil {
+				ack(ackErr)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			// -ERR与PING没有对应关系; 服务端按顺序处理命令, 发布相关的错误属于下一个PONG确认的消息
+			// 致命错误之后服务端会断开连接, 由failAcks处理
+			if strings.Contains(line, "Publish") {
+				b.mu.Lock()
+				if b.ackErr == nil {
+					b.ackErr = errors.New(line)
+				}
+				b.mu.Unlock()
+			}
+		}
+	}
+}
+
+// 连接断开时, 所有未确认的消息回调失败
+func (b *natsBroker) failAcks(err error) {
+	b.mu.Lock()
+	acks := b.acks
+	b.acks = nil
+	b.mu.Unlock()
+	for _, ack := range acks {
+		ack(err)
+	}
+}
+
+// 先等待已发布消息的确认(最多natsCloseTimeout), 再断开连接
+func (b *natsBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+	deadline := time.Now().Add(natsCloseTimeout)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		pending := len(b.acks)
+		b.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		select {
+		case <-b.done:
+			// 读协程已退出, 未确认的回调已失败
+			deadline = time.Now()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	err := b.conn.Close()
+	// 等待读协程退出, 保证Close返回后不再回调
+	<-b.done
+	return err
+}
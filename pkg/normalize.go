@@ -0,0 +1,166 @@
+package kite
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// http统计项的命令字格式, 与HTTPClientInterceptor一致
+func httpMethod(method string, u *url.URL) string {
+	return fmt.Sprintf("[%s]/%s", method, u.String())
+}
+
+// 从命令字中拆出http方法及url
+func splitHTTPMethod(method string) (string, *url.URL, bool) {
+	i := strings.Index(method, "]/")
+	if !strings.HasPrefix(method, "[") || i < 0 {
+		return "", nil, false
+	}
+	u, err := url.Parse(method[i+2:])
+	if err != nil {
+		return "", nil, false
+	}
+	return method[1:i], u, true
+}
+
+// 路径正则替换, 如`/items/\d+`替换为`/items/{id}`
+type URLRewrite struct {
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+// http统计项的url归一化规则, 避免每个不同的url都生成一个统计项
+type URLRules struct {
+	DropQuery bool     // 去掉查询参数
+	KeepQuery []string // DropQuery为false时, 非空则只保留这些查询参数
+	// 路径模板, 如/users/{id}/orders/{oid}, 段数相同且非{}段相等时路径替换为模板
+	Templates []string
+	Rewrites  []URLRewrite // 模板均不匹配时依次执行
+	AutoID    bool         // 纯数字, uuid及16位以上的十六进制段替换为{id}
+}
+
+var (
+	uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numSegment  = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// 按规则归一化url, 返回新的url
+func (rules *URLRules) Normalize(u *url.URL) *url.URL {
+	n := *u
+	n.Path = rules.normalizePath(u.Path)
+	n.RawPath = ""
+	if rules.DropQuery {
+		n.RawQuery = ""
+	} else if len(rules.KeepQuery) > 0 {
+		q := u.Query()
+		kept := url.Values{}
+		for _, k := range rules.KeepQuery {
+			if vs, ok := q[k]; ok {
+				kept[k] = vs
+			}
+		}
+		n.RawQuery = kept.Encode()
+	}
+	n.Fragment = ""
+	return &n
+}
+
+func (rules *URLRules) normalizePath(path string) string {
+	segs := strings.Split(path, "/")
+	for _, tpl := range rules.Templates {
+		if matchTemplate(strings.Split(tpl, "/"), segs) {
+			return tpl
+		}
+	}
+	for _, rw := range rules.Rewrites {
+		if rw.Pattern.MatchString(path) {
+			return rw.Pattern.ReplaceAllString(path, rw.Replace)
+		}
+	}
+	if rules.AutoID {
+		for i, seg := range segs {
+			if numSegment.MatchString(seg) || uuidSegment.MatchString(seg) || hexSegment.MatchString(seg) {
+				segs[i] = "{id}"
+			}
+		}
+		return strings.Join(segs, "/")
+	}
+	return path
+}
+
+func matchTemplate(tpl, segs []string) bool {
+	if len(tpl) != len(segs) {
+		return false
+	}
+	for i, t := range tpl {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segs[i] == "" {
+				return false
+			}
+			continue
+		}
+		if t != segs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// http统计项的命令字归一化, 非http格式的命令字原样返回
+func (rules *URLRules) normalizeMethod(method string) string {
+	verb, u, ok := splitHTTPMethod(method)
+	if !ok {
+		return method
+	}
+	// 路径中的{id}等占位符不转义
+	n := rules.Normalize(u)
+	target := (&url.URL{Scheme: n.Scheme, User: n.User, Host: n.Host}).String() + n.Path
+	if n.RawQuery != "" {
+		target += "?" + n.RawQuery
+	}
+	return fmt.Sprintf("[%s]/%s", verb, target)
+}
+
+// 超出MaxReportNum后新统计项归入的命令字, 统计项的消息类型取首个归入的结果
+const otherMethod = "[OTHER]"
+
+// 由Response生成统计项: 按URLRules归一化http命令字, 按GroupBy拼接标签维度
+func (s *Statistician) header(data *Response) Header {
+	h := Header{MsgType: data.MsgType, Method: data.Method}
+	if s.config.URLRules != nil && data.MsgType == MSG_HTTP {
+		h.Method = s.config.URLRules.normalizeMethod(h.Method)
+	}
+	if len(s.config.GroupBy) > 0 {
+		h.Tags = groupTags(data, s.config.GroupBy)
+	}
+	// [OTHER]计入上限: 普通统计项至多MaxReportNum-1个, 之后各消息类型新的统计项合并为同一个[OTHER]
+	if s.config.MaxReportNum > 0 && s.statistics[h] == nil && len(s.statistics) >= s.config.MaxReportNum-1 {
+		if s.other == nil {
+			s.other = &Header{MsgType: data.MsgType, Method: otherMethod}
+		}
+		h = *s.other
+	}
+	return h
+}
+
+// 按keys顺序拼接标签, 如region=sh,tenant=a, 缺失的标签为空值
+// 除Tags外也支持内置维度step, scenario
+func groupTags(data *Response, keys []string) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v, ok := data.Tags[k]
+		if !ok {
+			switch k {
+			case "step":
+				v = data.Step
+			case "scenario":
+				v = data.Scenario
+			}
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
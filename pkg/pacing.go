@@ -0,0 +1,93 @@
+package kite
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// 迭代节奏统计: 思考时间及固定间隔下的超时迭代
+type PacingStats struct {
+	PacingMS     int     // 固定迭代间隔, 0表示使用思考时间
+	Iterations   uint64  // 迭代数
+	AvgWaitMS    float64 // 迭代之间的平均等待时间
+	Overruns     uint64  // 耗时超出固定间隔的迭代数
+	MaxOverrunMS float64 // 最大超出时长
+}
+
+func (st *PacingStats) Output(logfn LogFunc) {
+	if st.PacingMS > 0 {
+		logfn("Pacing: 间隔 %dms | 迭代 %d | 平均等待 %.2fms | 超时迭代 %d次 max %.2fms\n",
+			st.PacingMS, st.Iterations, st.AvgWaitMS, st.Overruns, st.MaxOverrunMS)
+	} else {
+		logfn("Think time: 迭代 %d | 平均等待 %.2fms\n", st.Iterations, st.AvgWaitMS)
+	}
+	if w := st.Warning(); w != "" {
+		logfn("  WARNING: %s\n", w)
+	}
+}
+
+// 存在超时迭代时的提示, 否则为空
+func (st *PacingStats) Warning() string {
+	if st.Overruns == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d次迭代(%.1f%%)耗时超出固定间隔%dms, 实际发起频率低于预期",
+		st.Overruns, float64(st.Overruns)*100/float64(st.Iterations), st.PacingMS)
+}
+
+type pacingCounter struct {
+	iterations     uint64
+	waitNanos      int64
+	overruns       uint64
+	maxOverrunNano int64
+	warming        int32 // 预热期间为1, 不计数
+}
+
+// 计算下一次迭代的计划发起时间, start和end为本次迭代的起止时间
+func (c *pacingCounter) next(cfg *Config, start, end time.Time, rnd *rand.Rand) time.Time {
+	record := atomic.LoadInt32(&c.warming) == 0
+	if record {
+		atomic.AddUint64(&c.iterations, 1)
+	}
+	var wait time.Duration
+	if cfg.PacingMS > 0 {
+		// 固定节奏: 间隔包含请求本身耗时, 超出时立即开始下一次迭代
+		wait = start.Add(time.Duration(cfg.PacingMS) * time.Millisecond).Sub(end)
+		if wait < 0 {
+			if record {
+				atomic.AddUint64(&c.overruns, 1)
+				overrun := int64(-wait)
+				for {
+					max := atomic.LoadInt64(&c.maxOverrunNano)
+					if overrun <= max || atomic.CompareAndSwapInt64(&c.maxOverrunNano, max, overrun) {
+						break
+					}
+				}
+			}
+			wait = 0
+		}
+	} else if cfg.ThinkTime != nil {
+		wait = cfg.ThinkTime.Sample(rnd)
+	}
+	if record {
+		atomic.AddInt64(&c.waitNanos, int64(wait))
+	}
+	return end.Add(wait)
+}
+
+func (c *pacingCounter) endWarmup() { atomic.StoreInt32(&c.warming, 0) }
+
+func (c *pacingCounter) snapshot(cfg *Config) *PacingStats {
+	st := &PacingStats{
+		PacingMS:     cfg.PacingMS,
+		Iterations:   atomic.LoadUint64(&c.iterations),
+		Overruns:     atomic.LoadUint64(&c.overruns),
+		MaxOverrunMS: float64(atomic.LoadInt64(&c.maxOverrunNano)) / 1e6,
+	}
+	if st.Iterations > 0 {
+		st.AvgWaitMS = float64(atomic.LoadInt64(&c.waitNanos)) / 1e6 / float64(st.Iterations)
+	}
+	return st
+}
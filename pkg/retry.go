@@ -0,0 +1,171 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// 支持context的ReqHandler, 调度器通过ctx控制单次请求超时
+// 实现该接口后调度器调用OnRequestContext而不是OnRequest
+// 重试时以同一RunState再次调用OnRequestContext, 从共享数据源取请求的handler
+// 应在AttemptFromContext(ctx) > 1时重发上一次的请求
+type ContextReqHandler interface {
+	ReqHandler
+	OnRequestContext(ctx context.Context) error
+}
+
+// 带错误码的错误, OnRequest返回时用于匹配RetryPolicy.RetryableCodes
+type CodeError interface {
+	error
+	ErrCode() int
+}
+
+// 请求失败后的重试策略
+type RetryPolicy struct {
+	MaxAttempts    int     // 最大尝试次数(含首次), 小于2时不重试
+	BackoffMS      int     // 首次重试间隔, 之后每次翻倍
+	MaxBackoffMS   int     // 重试间隔上限, 0表示不限
+	Jitter         float64 // 随机抖动比例[0,1], 实际间隔在[(1-Jitter)*间隔, 间隔]内均匀分布
+	RetryableCodes []int   // 可重试的错误码, 为空时所有失败均重试
+}
+
+// 第attempt次重试前的等待时间, attempt从1开始
+func (p *RetryPolicy) backoff(attempt int, rnd *rand.Rand) time.Duration {
+	d := time.Duration(p.BackoffMS) * time.Millisecond
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoffMS > 0 && d >= time.Duration(p.MaxBackoffMS)*time.Millisecond {
+			break
+		}
+	}
+	if p.MaxBackoffMS > 0 && d > time.Duration(p.MaxBackoffMS)*time.Millisecond {
+		d = time.Duration(p.MaxBackoffMS) * time.Millisecond
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(float64(d) * p.Jitter * rnd.Float64())
+	}
+	return d
+}
+
+func (p *RetryPolicy) retryable(errCode int) bool {
+	if len(p.RetryableCodes) == 0 {
+		return true
+	}
+	for _, code := range p.RetryableCodes {
+		if code == errCode {
+			return true
+		}
+	}
+	return false
+}
+
+// 调度器视角的请求结果统计, 一次请求包含首次尝试及其重试
+type RetryStats struct {
+	Requests     uint64 // 请求数
+	FirstSuccess uint64 // 首次尝试即成功的请求数
+	FirstFailure uint64 // 首次尝试失败的请求数
+	Retries      uint64 // 重试次数
+	FinalSuccess uint64 // 最终成功的请求数
+	FinalFailure uint64 // 重试后仍失败的请求数
+}
+
+func (st *RetryStats) Output(logfn LogFunc) {
+	logfn("Requests: %d | 首次成功 %d 首次失败 %d | 重试 %d次 | 最终成功 %d 最终失败 %d\n",
+		st.Requests, st.FirstSuccess, st.FirstFailure, st.Retries, st.FinalSuccess, st.FinalFailure)
+}
+
+type retryCounter struct {
+	requests     uint64
+	firstSuccess uint64
+	retries      uint64
+	finalSuccess uint64
+	warming      int32 // 预热期间为1, 不计数
+}
+
+// 记录一次请求的结果, attempts为实际尝试次数
+func (c *retryCounter) record(attempts int, ok bool) {
+	if atomic.LoadInt32(&c.warming) != 0 {
+		return
+	}
+	atomic.AddUint64(&c.requests, 1)
+	atomic.AddUint64(&c.retries, uint64(attempts-1))
+	if ok {
+		atomic.AddUint64(&c.finalSuccess, 1)
+		if attempts == 1 {
+			atomic.AddUint64(&c.firstSuccess, 1)
+		}
+	}
+}
+
+func (c *retryCounter) endWarmup() { atomic.StoreInt32(&c.warming, 0) }
+
+func (c *retryCounter) snapshot() *RetryStats {
+	// 先读成功数再读请求数, 保证并发记录时请求数不小于成功数
+	st := &RetryStats{
+		FirstSuccess: atomic.LoadUint64(&c.firstSuccess),
+		FinalSuccess: atomic.LoadUint64(&c.finalSuccess),
+		Retries:      atomic.LoadUint64(&c.retries),
+	}
+	st.Requests = atomic.LoadUint64(&c.requests)
+	st.FirstFailure = st.Requests - st.FirstSuccess
+	st.FinalFailure = st.Requests - st.FinalSuccess
+	return st
+}
+
+type attemptKey struct{}
+
+// 单次尝试的状态, 通过ctx传递给拦截器
+type attemptState struct {
+	attempt int
+	errCode int64 // 拦截器上报的最近一次失败错误码
+	failed  int32
+	sent    int32 // 本次尝试已通过FillResponse上报过结果
+}
+
+func withAttempt(ctx context.Context, attempt int) (context.Context, *attemptState) {
+	st := &attemptState{attempt: attempt}
+	return context.WithValue(ctx, attemptKey{}, st), st
+}
+
+// ctx对应的尝试序号, 1为首次, 不经过调度器时返回0
+func AttemptFromContext(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+	if st, ok := ctx.Value(attemptKey{}).(*attemptState); ok {
+		return st.attempt
+	}
+	return 0
+}
+
+// 记录拦截器上报的失败错误码, 供重试判断
+func (st *attemptState) observe(result *Response) {
+	atomic.StoreInt32(&st.sent, 1)
+	if !result.IsSucceed {
+		atomic.StoreInt64(&st.errCode, int64(result.ErrCode))
+		atomic.StoreInt32(&st.failed, 1)
+	}
+}
+
+// 本次尝试是否已上报过结果
+func (st *attemptState) reported() bool {
+	return atomic.LoadInt32(&st.sent) == 1
+}
+
+// 本次尝试的错误码: 优先使用拦截器上报的错误码, 其次为超时及CodeError
+func (st *attemptState) code(err error) int {
+	if atomic.LoadInt32(&st.failed) == 1 {
+		return int(atomic.LoadInt64(&st.errCode))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ERR_CODE_TIMEOUT
+	}
+	var ce CodeError
+	if errors.As(err, &ce) {
+		return ce.ErrCode()
+	}
+	return ERR_CODE_HANDLER
+}
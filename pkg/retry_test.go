@@ -0,0 +1,169 @@
+package kite
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		name   string
+		policy RetryPolicy
+		want   []time.Duration // 第1, 2, ...次重试前的等待时间
+	}{
+		{"doubling", RetryPolicy{BackoffMS: 10}, []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms}},
+		{"capped", RetryPolicy{BackoffMS: 10, MaxBackoffMS: 25}, []time.Duration{10 * ms, 20 * ms, 25 * ms, 25 * ms}},
+		{"zero", RetryPolicy{}, []time.Duration{0, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			var got []time.Duration
+			for attempt := 1; attempt <= len(c.want); attempt++ {
+				got = append(got, c.policy.backoff(attempt, rnd))
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("backoff = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoffJitter(t *testing.T) {
+	p := &RetryPolicy{BackoffMS: 100, Jitter: 0.5}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(1, rnd); d < 50*time.Millisecond || d > 100*time.Millisecond {
+			t.Fatalf("backoff with jitter = %v, want in [50ms, 100ms]", d)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		codes []int
+		code  int
+		want  bool
+	}{
+		{nil, ERR_CODE_REQUEST, true},
+		{[]int{503, ERR_CODE_TIMEOUT}, 503, true},
+		{[]int{503, ERR_CODE_TIMEOUT}, ERR_CODE_TIMEOUT, true},
+		{[]int{503, ERR_CODE_TIMEOUT}, 500, false},
+	}
+	for _, c := range cases {
+		if got := (&RetryPolicy{RetryableCodes: c.codes}).retryable(c.code); got != c.want {
+			t.Errorf("retryable(%v, %d) = %v, want %v", c.codes, c.code, got, c.want)
+		}
+	}
+}
+
+// 码为code的错误
+type codeErr int
+
+func (e codeErr) Error() string { return "code error" }
+func (e codeErr) ErrCode() int  { return int(e) }
+
+func TestSchedulerRetry(t *testing.T) {
+	const requests = 4
+	cases := []struct {
+		name      string
+		policy    *RetryPolicy
+		timeoutMS int
+		failTimes int // 每个请求前几次尝试失败
+		fail      func(ctx context.Context, results chan<- *Response) error
+		want      RetryStats
+	}{
+		{"retry until success", &RetryPolicy{MaxAttempts: 3}, 0, 2, reportFailure(503),
+			RetryStats{Requests: requests, FirstFailure: requests, Retries: 2 * requests, FinalSuccess: requests}},
+		{"attempts exhausted", &RetryPolicy{MaxAttempts: 2}, 0, 3, reportFailure(503),
+			RetryStats{Requests: requests, FirstFailure: requests, Retries: requests, FinalFailure: requests}},
+		{"reported code not retryable", &RetryPolicy{MaxAttempts: 3, RetryableCodes: []int{503}}, 0, 1, reportFailure(500),
+			RetryStats{Requests: requests, FirstFailure: requests, FinalFailure: requests}},
+		{"returned code retryable", &RetryPolicy{MaxAttempts: 3, RetryableCodes: []int{503}}, 0, 1,
+			func(ctx context.Context, results chan<- *Response) error { return codeErr(503) },
+			RetryStats{Requests: requests, FirstFailure: requests, Retries: requests, FinalSuccess: requests}},
+		{"timeout retryable", &RetryPolicy{MaxAttempts: 2, RetryableCodes: []int{ERR_CODE_TIMEOUT}}, 10, 1,
+			func(ctx context.Context, results chan<- *Response) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			RetryStats{Requests: requests, FirstFailure: requests, Retries: requests, FinalSuccess: requests}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Config{ConcurrencyNum: 1, ReqNumPerConcy: requests, ResultsBufferSize: 64,
+				Retry: c.policy, RequestTimeoutMS: c.timeoutMS}
+			var seen []int // 各次调用的尝试序号
+			reports, err := quietServer().Run(cfg, &Request{}, func() ReqHandler {
+				return &funcHandler{onRequest: func(ctx context.Context, results chan<- *Response) error {
+					attempt := AttemptFromContext(ctx)
+					seen = append(seen, attempt)
+					if attempt <= c.failTimes {
+						return c.fail(ctx, results)
+					}
+					result := &Response{MsgType: MSG_HTTP, Method: "GET /", IsSucceed: true, ErrCode: 200}
+					FillResponse(ctx, result)
+					SendResponse(results, result)
+					return nil
+				}}
+			})
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if len(reports) == 0 || reports[0].Retry == nil {
+				t.Fatal("no retry stats")
+			}
+			if got := *reports[0].Retry; got != c.want {
+				t.Errorf("retry stats = %+v, want %+v", got, c.want)
+			}
+			if uint64(len(seen)) != c.want.Requests+c.want.Retries {
+				t.Errorf("%d calls (attempts %v), want %d", len(seen), seen, c.want.Requests+c.want.Retries)
+			}
+		})
+	}
+}
+
+// 上报错误码为code的失败结果并返回nil, 模拟拦截器
+func reportFailure(code int) func(ctx context.Context, results chan<- *Response) error {
+	return func(ctx context.Context, results chan<- *Response) error {
+		result := &Response{MsgType: MSG_HTTP, Method: "GET /", ErrCode: code, ErrMsg: "unavailable"}
+		FillResponse(ctx, result)
+		SendResponse(results, result)
+		return nil
+	}
+}
+
+// 只实现OnRequest的handler超时时记为超时, 且不会在上一次调用返回前再次调用
+func TestLegacyRequestTimeout(t *testing.T) {
+	cfg := &Config{ConcurrencyNum: 1, ReqNumPerConcy: 2, ResultsBufferSize: 16, RequestTimeoutMS: 10,
+		Retry: &RetryPolicy{MaxAttempts: 2}}
+	var running, overlap int32
+	reports, err := quietServer().Run(cfg, &Request{}, func() ReqHandler {
+		return &legacyHandler{onRequest: func() error {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.StoreInt32(&overlap, 1)
+			}
+			time.Sleep(30 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		}}
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if overlap != 0 {
+		t.Error("OnRequest called concurrently after timeout")
+	}
+	r := findReport(reports, MSG_HANDLER, "OnRequest")
+	if r == nil || r.Errors[ERR_CODE_TIMEOUT] != 4 {
+		t.Errorf("handler report = %+v, want 4 timeouts", r)
+	}
+	if st := reports[0].Retry; st == nil || st.Retries != 2 || st.FinalFailure != 2 {
+		t.Errorf("retry stats = %+v, want 2 retries and 2 final failures", st)
+	}
+}
@@ -0,0 +1,104 @@
+package kite
+
+import (
+	"context"
+	"time"
+)
+
+// 单次迭代的运行状态, 由调度器通过ctx传给ContextReqHandler.OnRequestContext
+// 拦截器通过FillResponse将其填入Response, 供下游按worker, 迭代, 场景等分组
+type RunState struct {
+	Worker    int               // worker序号, 从0开始
+	Iteration int               // 该worker的迭代序号, 从1开始
+	Scenario  string            // 场景名, 取自Config.Scenario
+	Step      string            // 场景中的步骤名, 通过WithStep设置
+	Tags      map[string]string // 自定义标签, 通过WithTags设置
+}
+
+type runStateKey struct{}
+
+func withRunState(ctx context.Context, rs *RunState) context.Context {
+	return context.WithValue(ctx, runStateKey{}, rs)
+}
+
+// ctx中的运行状态, 不经过调度器时返回nil
+func RunStateFromContext(ctx context.Context) *RunState {
+	if ctx == nil {
+		return nil
+	}
+	rs, _ := ctx.Value(runStateKey{}).(*RunState)
+	return rs
+}
+
+// 返回步骤名为step的ctx, 之后以该ctx发起的请求结果带有Step
+func WithStep(ctx context.Context, step string) context.Context {
+	rs := RunState{}
+	if old := RunStateFromContext(ctx); old != nil {
+		rs = *old
+	}
+	rs.Step = step
+	return withRunState(ctx, &rs)
+}
+
+// 返回附加了标签的ctx, kv为key, value交替排列
+func WithTags(ctx context.Context, kv ...string) context.Context {
+	rs := RunState{}
+	if old := RunStateFromContext(ctx); old != nil {
+		rs = *old
+	}
+	tags := make(map[string]string, len(rs.Tags)+len(kv)/2)
+	for k, v := range rs.Tags {
+		tags[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		tags[kv[i]] = kv[i+1]
+	}
+	rs.Tags = tags
+	return withRunState(ctx, &rs)
+}
+
+// 将ctx中的运行状态及尝试序号填入result, 拦截器及自定义ReqHandler在上报结果前调用
+// result为失败时, 其错误码用于重试判断
+func FillResponse(ctx context.Context, result *Response) {
+	fillRunState(ctx, result)
+	if ctx == nil {
+		return
+	}
+	if st, ok := ctx.Value(attemptKey{}).(*attemptState); ok {
+		st.observe(result)
+	}
+}
+
+// 只填充运行状态, 不参与重试判断
+func fillRunState(ctx context.Context, result *Response) {
+	if ctx == nil {
+		return
+	}
+	if rs := RunStateFromContext(ctx); rs != nil {
+		result.Worker = rs.Worker
+		result.Iteration = rs.Iteration
+		result.Scenario = rs.Scenario
+		result.Step = rs.Step
+		if len(rs.Tags) > 0 {
+			// 复制一份, 避免结果之间共享ctx中的标签; filter已设置的同名标签优先
+			tags := make(map[string]string, len(rs.Tags)+len(result.Tags))
+			for k, v := range rs.Tags {
+				tags[k] = v
+			}
+			for k, v := range result.Tags {
+				tags[k] = v
+			}
+			result.Tags = tags
+		}
+	}
+	if st, ok := ctx.Value(attemptKey{}).(*attemptState); ok {
+		result.Attempt = st.attempt
+	}
+}
+
+// 结果的开始时间, 未填写时由结束时间及UseTime推算
+func (r *Response) fillStartTime(end time.Time) {
+	if r.StartTime.IsZero() {
+		r.StartTime = end.Add(-time.Duration(r.UseTime))
+	}
+}
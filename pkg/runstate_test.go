@@ -0,0 +1,41 @@
+package kite
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestFillResponseTags(t *testing.T) {
+	cases := []struct {
+		name    string
+		ctxTags []string
+		preset  map[string]string // filter已设置的标签
+		want    map[string]string
+	}{
+		{"ctx only", []string{"region", "us"}, nil, map[string]string{"region": "us"}},
+		{"preset only", nil, map[string]string{"code": "200"}, map[string]string{"code": "200"}},
+		{"merged, preset wins", []string{"region", "us", "code", "0"}, map[string]string{"code": "200"},
+			map[string]string{"region": "us", "code": "200"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := withRunState(context.Background(), &RunState{})
+			if c.ctxTags != nil {
+				ctx = WithTags(ctx, c.ctxTags...)
+			}
+			result := &Response{Tags: c.preset}
+			FillResponse(ctx, result)
+			if !reflect.DeepEqual(result.Tags, c.want) {
+				t.Errorf("tags = %v, want %v", result.Tags, c.want)
+			}
+			// 修改结果的标签不影响ctx中的标签
+			if result.Tags != nil {
+				result.Tags["mutated"] = "1"
+			}
+			if _, ok := RunStateFromContext(ctx).Tags["mutated"]; ok {
+				t.Error("result tags share the ctx map")
+			}
+		})
+	}
+}
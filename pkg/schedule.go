@@ -1,53 +1,503 @@
 package kite
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// 开环压测中等待空闲worker的计划请求上限, 排满后到达过程随之阻塞
+const arrivalQueueSize = 4096
+
+const (
+	runStateRunning int32 = iota
+	runStatePaused
+	runStateAborted
+)
+
+// 压测运行控制: 暂停, 恢复, 中止及进度统计
+type runControl struct {
+	state   int32
+	mu      sync.Mutex
+	cond    *sync.Cond
+	active  int64  // 活跃worker数
+	done    uint64 // 已完成请求数
+	planned uint64 // 计划请求数
+	start   time.Time
+	abortCh chan struct{} // 中止时关闭
+
+	duration    time.Duration // 计划时长(DurationSec)
+	pausedAt    time.Time     // 本次暂停开始时间
+	pausedTotal time.Duration // 已结束的暂停累计时长
+}
+
+func newRunControl(cfg *Config) *runControl {
+	c := &runControl{
+		planned:  uint64(cfg.ConcurrencyNum * cfg.ReqNumPerConcy),
+		duration: time.Duration(cfg.DurationSec) * time.Second,
+		start:    time.Now(),
+		abortCh:  make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// 等待直到可以发起下一个请求, 返回false表示已中止
+func (c *runControl) wait() bool {
+	if atomic.LoadInt32(&c.state) == runStateRunning {
+		return true
+	}
+	c.mu.Lock()
+	for atomic.LoadInt32(&c.state) == runStatePaused {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+	return atomic.LoadInt32(&c.state) != runStateAborted
+}
+
+// 等待到t, 返回false表示期间已中止
+func (c *runControl) sleepUntil(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return !c.aborted()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.abortCh:
+		return false
+	}
+}
+
+func (c *runControl) setState(state int32) {
+	c.mu.Lock()
+	if old := atomic.LoadInt32(&c.state); old != runStateAborted {
+		if old == runStateRunning && state == runStatePaused {
+			c.pausedAt = time.Now()
+		} else if old == runStatePaused && state != runStatePaused {
+			c.pausedTotal += time.Since(c.pausedAt)
+		}
+		atomic.StoreInt32(&c.state, state)
+		if state == runStateAborted {
+			close(c.abortCh)
+		}
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+func (c *runControl) pause()  { c.setState(runStatePaused) }
+func (c *runControl) resume() { c.setState(runStateRunning) }
+func (c *runControl) abort()  { c.setState(runStateAborted) }
+
+func (c *runControl) paused() bool {
+	return atomic.LoadInt32(&c.state) == runStatePaused
+}
+
+func (c *runControl) aborted() bool {
+	return atomic.LoadInt32(&c.state) == runStateAborted
+}
+
+// 累计暂停时长(含正在进行的暂停), 用于顺延DurationSec
+func (c *runControl) pausedFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := c.pausedTotal
+	if atomic.LoadInt32(&c.state) == runStatePaused {
+		total += time.Since(c.pausedAt)
+	}
+	return total
+}
+
 type Server struct {
 	logfn LogFunc
+	mu    sync.Mutex
+	ctl   *runControl // 当前运行的控制器
 }
 
 func (s *Server) init() {
 	s.logfn = fmt.Printf
 }
 
-func (s *Server) newTransport(cfg *Config, req *Request, results chan<- *Response, handler ReqHandler) error {
-	err := handler.Init(req, results)
+// 单次运行的共享状态
+type runner struct {
+	cfg     *Config
+	req     *Request
+	results chan *Response
+	ctl     *runControl
+	health  *healthMonitor
+	errs    errCollector
+	panics  int64 // 已恢复的panic次数
+	retries retryCounter
+	pacing  pacingCounter
+
+	ready       sync.WaitGroup // 所有worker完成初始化
+	arrivals    chan time.Time // 开环压测的计划发起时间, 闭环时为nil
+	workersDone chan struct{}
+	deadline    time.Time // DurationSec对应的结束时间, 未配置时为零值
+}
+
+// 上报ReqHandler生命周期的失败结果, ctx为OnRequest的运行状态, 其他方法为nil
+func (r *runner) reportHandlerError(method string, errCode int, err error, ctx context.Context, startTime time.Time) {
+	result := &Response{
+		MsgType:   MSG_HANDLER,
+		Method:    method,
+		StartTime: startTime,
+		UseTime:   uint64(time.Since(startTime)),
+		IsSucceed: false,
+		ErrCode:   errCode,
+		ErrMsg:    err.Error(),
+	}
+	fillRunState(ctx, result)
+	SendResponse(r.results, result)
+}
+
+// 调用ReqHandler方法, 返回错误及panic都会计入handler统计
+// panic被恢复并转换为*PanicError, 堆栈通过logfn输出
+func (s *Server) callHandler(r *runner, method string, fn func() error) error {
+	return s.invokeHandler(r, method, nil, fn)
+}
+
+// 同callHandler, ctx非nil时为OnRequest的一次尝试, 超时以ERR_CODE_TIMEOUT统计
+// 拦截器已为本次尝试上报结果时, 返回的错误不再计入handler统计, 避免同一失败计两次
+func (s *Server) invokeHandler(r *runner, method string, ctx context.Context, fn func() error) (err error) {
+	startTime := time.Now()
+	defer func() {
+		v := recover()
+		if v == nil {
+			if err != nil && !attemptReported(ctx) {
+				errCode := ERR_CODE_HANDLER
+				if ctx != nil && errors.Is(err, context.DeadlineExceeded) {
+					errCode = ERR_CODE_TIMEOUT
+				}
+				r.reportHandlerError(method, errCode, err, ctx, startTime)
+			}
+			return
+		}
+		// 在其他goroutine中恢复后转抛的panic已带有原始堆栈
+		pe, ok := v.(*PanicError)
+		if !ok {
+			pe = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+		s.reportPanic(r, method, ctx, startTime, pe)
+		err = pe
+	}()
+	return fn()
+}
+
+func attemptReported(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	st, ok := ctx.Value(attemptKey{}).(*attemptState)
+	return ok && st.reported()
+}
+
+func (s *Server) reportPanic(r *runner, method string, ctx context.Context, startTime time.Time, pe *PanicError) {
+	s.logfn("%s panic: %v\n%s\n", method, pe.Value, pe.Stack)
+	r.reportHandlerError(method, ERR_CODE_PANIC, pe, ctx, startTime)
+	n := atomic.AddInt64(&r.panics, 1)
+	if r.cfg.MaxPanics > 0 && n >= int64(r.cfg.MaxPanics) && !r.ctl.aborted() {
+		s.logfn("panic num reach %d, abort run\n", n)
+		r.ctl.abort()
+	}
+}
+
+// 在独立goroutine中执行的OnRequest, 用于对不支持ctx的handler施加超时
+type legacyCall struct {
+	done  chan struct{} // 调用返回时关闭
+	err   error
+	panic *PanicError
+}
+
+// 执行fn直到返回或ctx超时, 超时时返回ctx.Err(), fn仍在后台执行
+func (c *legacyCall) run(ctx context.Context, fn func() error) error {
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		defer func() {
+			if v := recover(); v != nil {
+				c.panic = &PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+		c.err = fn()
+	}()
+	select {
+	case <-c.done:
+		if c.panic != nil {
+			panic(c.panic)
+		}
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 按InitFailPolicy初始化handler, 失败时返回最后一次的错误
+func (s *Server) initHandler(r *runner, newHandler NewReqHandlerFunc) (ReqHandler, error) {
+	backoff := time.Duration(r.cfg.InitRetryBackoffMS) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var handler ReqHandler
+		err := s.callHandler(r, "Init", func() error {
+			handler = newHandler()
+			return handler.Init(r.req, r.results)
+		})
+		if err == nil {
+			return handler, nil
+		}
+		if r.cfg.InitFailPolicy != InitFailRetry || attempt >= r.cfg.InitRetryNum || r.ctl.aborted() {
+			return nil, err
+		}
+		s.logfn("init handler err:%v, retry after %v\n", err, backoff)
+		if !r.ctl.sleepUntil(time.Now().Add(backoff)) {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// 发起一次请求, 按RequestTimeoutMS限制每次尝试的时长, 失败时按Retry重试
+// 只实现OnRequest的handler在超时时先记为超时, 待该次调用返回后才发起下一次调用(handler不要求并发安全)
+func (s *Server) doRequest(r *runner, handler ReqHandler, rs *RunState, rnd *rand.Rand) {
+	ctxHandler, _ := handler.(ContextReqHandler)
+	for attempt := 1; ; attempt++ {
+		ctx, st := withAttempt(withRunState(context.Background(), rs), attempt)
+		cancel := context.CancelFunc(func() {})
+		if r.cfg.RequestTimeoutMS > 0 {
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(r.cfg.RequestTimeoutMS)*time.Millisecond)
+		}
+		var call *legacyCall
+		startTime := time.Now()
+		// 没有上报结果的OnRequest错误(如建立连接失败)计入handler统计
+		err := s.invokeHandler(r, "OnRequest", ctx, func() error {
+			if ctxHandler != nil {
+				return ctxHandler.OnRequestContext(ctx)
+			}
+			if r.cfg.RequestTimeoutMS <= 0 {
+				return handler.OnRequest()
+			}
+			call = &legacyCall{}
+			return call.run(ctx, handler.OnRequest)
+		})
+		cancel()
+		if call != nil && errors.Is(err, context.DeadlineExceeded) {
+			<-call.done
+			if call.panic != nil {
+				s.reportPanic(r, "OnRequest", ctx, startTime, call.panic)
+			}
+		}
+		ok := err == nil && atomic.LoadInt32(&st.failed) == 0
+		policy := r.cfg.Retry
+		if ok || policy == nil || attempt >= policy.MaxAttempts || r.ctl.aborted() {
+			r.retries.record(attempt, ok)
+			return
+		}
+		if _, panicked := err.(*PanicError); panicked || !policy.retryable(st.code(err)) {
+			r.retries.record(attempt, false)
+			return
+		}
+		if !r.ctl.sleepUntil(time.Now().Add(policy.backoff(attempt, rnd))) {
+			r.retries.record(attempt, false)
+			return
+		}
+	}
+}
+
+// 是否还能发起第i个请求: 未达到ReqNumPerConcy(为0且配置了DurationSec时不限)且未超过DurationSec(暂停期间顺延)
+func (r *runner) more(i int) bool {
+	if r.cfg.ReqNumPerConcy > 0 || r.cfg.DurationSec == 0 {
+		if i >= r.cfg.ReqNumPerConcy {
+			return false
+		}
+	}
+	return r.deadline.IsZero() || time.Now().Before(r.deadline.Add(r.ctl.pausedFor()))
+}
+
+// 第worker个worker的第iteration次迭代的运行状态
+func (r *runner) runState(worker, iteration int) *RunState {
+	return &RunState{Worker: worker, Iteration: iteration, Scenario: r.cfg.Scenario}
+}
+
+func (s *Server) newTransport(r *runner, worker int, newHandler NewReqHandlerFunc) error {
+	handler, err := s.initHandler(r, newHandler)
+	r.ready.Done()
 	if err != nil {
 		return err
 	}
-	for i := 0; i < cfg.ReqNumPerConcy; i++ {
-		err = handler.OnRequest()
-		if err != nil {
-			fmt.Printf("on request %s err:%v\n", req.Url, err)
+	atomic.AddInt64(&r.ctl.active, 1)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	if r.arrivals != nil {
+		// 开环压测: 按到达过程的计划时间发起, worker全忙时排队, 排队时间计入发起延迟
+		iteration := 0
+		for scheduled := range r.arrivals {
+			if r.ctl.aborted() {
+				// 终止后丢弃队列中剩余的计划请求, 队列在分发协程退出时关闭
+				continue
+			}
+			iteration++
+			r.health.recordDispatch(scheduled, time.Now())
+			s.doRequest(r, handler, r.runState(worker, iteration), rnd)
+			atomic.AddUint64(&r.ctl.done, 1)
+		}
+	} else {
+		scheduled := time.Now()
+		for i := 0; r.more(i) && r.ctl.sleepUntil(scheduled) && r.ctl.wait(); i++ {
+			// 闭环压测中, 上一个请求结束(加上思考时间或按固定节奏)即为下一个请求的计划发起时间
+			start := time.Now()
+			r.health.recordDispatch(scheduled, start)
+			s.doRequest(r, handler, r.runState(worker, i+1), rnd)
+			atomic.AddUint64(&r.ctl.done, 1)
+			scheduled = r.pacing.next(r.cfg, start, time.Now(), rnd)
 		}
 	}
-	handler.Close()
+	atomic.AddInt64(&r.ctl.active, -1)
+	s.callHandler(r, "Close", func() error {
+		handler.Close()
+		return nil
+	})
 	return nil
 }
 
+// 按到达过程生成计划发起时间, 所有worker初始化完成后开始
+// 总数为ConcurrencyNum*ReqNumPerConcy(为0且配置了DurationSec时不限), 暂停期间顺延
+func (s *Server) dispatchArrivals(r *runner) {
+	defer close(r.arrivals)
+	r.ready.Wait()
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	arrival := r.cfg.Arrival
+	if sa, ok := arrival.(statefulArrival); ok {
+		arrival = sa.newRun()
+	}
+	total := r.cfg.ConcurrencyNum * r.cfg.ReqNumPerConcy
+	start := time.Now()
+	if r.cfg.DurationSec > 0 {
+		r.deadline = start.Add(time.Duration(r.cfg.DurationSec) * time.Second)
+	}
+	var offset time.Duration
+	for n := 0; total > 0 || r.cfg.DurationSec > 0; n++ {
+		if total > 0 && n >= total {
+			return
+		}
+		gap, ok := arrival.Next(offset, rnd)
+		if !ok {
+			return
+		}
+		offset += gap
+		scheduled := start.Add(offset)
+		if !r.deadline.IsZero() && scheduled.After(r.deadline) {
+			return
+		}
+		if !r.ctl.sleepUntil(scheduled) {
+			return
+		}
+		if r.ctl.paused() {
+			pauseStart := time.Now()
+			if !r.ctl.wait() {
+				return
+			}
+			paused := time.Since(pauseStart)
+			start = start.Add(paused)
+			scheduled = scheduled.Add(paused)
+			if !r.deadline.IsZero() {
+				r.deadline = r.deadline.Add(paused)
+			}
+		}
+		// 已终止时不再入队, 避免select随机选中发送分支
+		if r.ctl.aborted() {
+			return
+		}
+		select {
+		case r.arrivals <- scheduled:
+		case <-r.ctl.abortCh:
+			return
+		case <-r.workersDone:
+			// 所有worker均已退出(如初始化失败)
+			return
+		}
+	}
+}
+
 func (s *Server) Run(cfg *Config, req *Request, newHandler NewReqHandlerFunc) ([]*Report, error) {
+	return s.run(cfg, req, newHandler, false)
+}
+
+// stage为true时作为容量搜索的阶段执行, 不输出统计表
+func (s *Server) run(cfg *Config, req *Request, newHandler NewReqHandlerFunc, stage bool) ([]*Report, error) {
 	var wg sync.WaitGroup
 	results := make(chan *Response, cfg.ResultsBufferSize)
 	done := make(chan []*Report)
-	stat := &Statistician{config: cfg, logfn: s.logfn}
+	r := &runner{
+		cfg:         cfg,
+		req:         req,
+		results:     results,
+		ctl:         newRunControl(cfg),
+		workersDone: make(chan struct{}),
+		health:      newHealthMonitor(results),
+	}
+	if cfg.WarmupSec > 0 || cfg.WarmupReqNum > 0 {
+		r.retries.warming, r.pacing.warming, r.health.warming = 1, 1, 1
+	}
+	s.mu.Lock()
+	s.ctl = r.ctl
+	s.mu.Unlock()
+	r.health.run()
+	stat := &Statistician{config: cfg, logfn: s.logfn, health: r.health, stage: stage}
+	if cfg.Retry != nil {
+		stat.retries = &r.retries
+	}
+	if cfg.PacingMS > 0 || cfg.ThinkTime != nil {
+		stat.pacing = &r.pacing
+	}
+	if cfg.Dashboard {
+		stat.dash = newDashboard(r.ctl)
+		stat.dash.start()
+	}
 	go stat.Start(results, done)
+	r.ready.Add(cfg.ConcurrencyNum)
+	if cfg.Arrival != nil {
+		r.arrivals = make(chan time.Time, arrivalQueueSize)
+		go s.dispatchArrivals(r)
+	} else if cfg.DurationSec > 0 {
+		r.deadline = time.Now().Add(time.Duration(cfg.DurationSec) * time.Second)
+	}
 	for i := 0; i < cfg.ConcurrencyNum; i++ {
 		wg.Add(1)
-		go func() {
-			err := s.newTransport(cfg, req, results, newHandler())
+		go func(worker int) {
+			defer wg.Done()
+			err := s.newTransport(r, worker, newHandler)
 			if err != nil {
-				fmt.Printf("new transport err:%v", err)
+				s.logfn("new transport err:%v\n", err)
+				r.errs.addInitError(err)
+				if cfg.InitFailPolicy == InitFailAbort {
+					r.ctl.abort()
+				}
 			}
-			wg.Done()
-		}()
+		}(i)
 	}
 	wg.Wait()
+	close(r.workersDone)
+	if cfg.OnWorkersDone != nil {
+		cfg.OnWorkersDone(results)
+	}
 	close(results)
 	reports := <-done
-	return reports, nil
+	r.health.stop()
+	s.mu.Lock()
+	s.ctl = nil
+	s.mu.Unlock()
+	if cfg.HTMLReportPath != "" {
+		if err := WriteHTMLReportFile(cfg.HTMLReportPath, reports); err != nil {
+			return reports, err
+		}
+	}
+	return reports, r.errs.result(cfg.ConcurrencyNum, r.ctl.aborted())
 }
 
 func (s *Server) RunWithSimpleArgs(targetUrl string, concyNum int, reqNumPerConcy int, newHandler NewReqHandlerFunc) ([]*Report, error) {
@@ -66,3 +516,29 @@ func (s *Server) RedirectLog(logfn LogFunc) {
 		s.logfn = logfn
 	}
 }
+
+// 暂停当前运行, worker在发起下一个请求前阻塞
+func (s *Server) Pause() {
+	s.mu.Lock()
+	if s.ctl != nil {
+		s.ctl.pause()
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) Resume() {
+	s.mu.Lock()
+	if s.ctl != nil {
+		s.ctl.resume()
+	}
+	s.mu.Unlock()
+}
+
+// 中止当前运行, 已收集的统计数据仍会输出, Run返回ErrRunAborted
+func (s *Server) Abort() {
+	s.mu.Lock()
+	if s.ctl != nil {
+		s.ctl.abort()
+	}
+	s.mu.Unlock()
+}
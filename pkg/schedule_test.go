@@ -0,0 +1,218 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用handler, onRequest返回nil时不上报结果
+type funcHandler struct {
+	results   chan<- *Response
+	init      func() error
+	onRequest func(ctx context.Context, results chan<- *Response) error
+}
+
+func (h *funcHandler) Init(req *Request, results chan<- *Response) error {
+	h.results = results
+	if h.init != nil {
+		return h.init()
+	}
+	return nil
+}
+
+func (h *funcHandler) OnRequest() error { return h.OnRequestContext(context.Background()) }
+
+func (h *funcHandler) OnRequestContext(ctx context.Context) error {
+	return h.onRequest(ctx, h.results)
+}
+
+func (h *funcHandler) Close() {}
+
+func quietServer() *Server {
+	s := NewServer()
+	s.RedirectLog(func(format string, a ...interface{}) (int, error) { return 0, nil })
+	return s
+}
+
+func findReport(reports []*Report, mt MsgType, method string) *Report {
+	for _, r := range reports {
+		if r.MsgType == mt && r.Method == method {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestOnRequestErrorCounting(t *testing.T) {
+	errDial := errors.New("dial failed")
+	cases := []struct {
+		name        string
+		sendResult  bool // 拦截器已上报失败结果
+		wantHandler uint64
+		wantRequest uint64
+	}{
+		{"no response", false, 5, 0},
+		{"reported by interceptor", true, 0, 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Config{ConcurrencyNum: 1, ReqNumPerConcy: 5, ResultsBufferSize: 16}
+			reports, err := quietServer().Run(cfg, &Request{}, func() ReqHandler {
+				return &funcHandler{onRequest: func(ctx context.Context, results chan<- *Response) error {
+					if c.sendResult {
+						result := &Response{MsgType: MSG_HTTP, Method: "GET /", ErrCode: ERR_CODE_REQUEST, ErrMsg: errDial.Error()}
+						FillResponse(ctx, result)
+						SendResponse(results, result)
+					}
+					return errDial
+				}}
+			})
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			var handlerFails, requestFails uint64
+			if r := findReport(reports, MSG_HANDLER, "OnRequest"); r != nil {
+				handlerFails = r.FailureNum
+			}
+			if r := findReport(reports, MSG_HTTP, "GET /"); r != nil {
+				requestFails = r.FailureNum
+			}
+			if handlerFails != c.wantHandler || requestFails != c.wantRequest {
+				t.Errorf("handler/request failures = %d/%d, want %d/%d", handlerFails, requestFails, c.wantHandler, c.wantRequest)
+			}
+		})
+	}
+}
+
+func TestInitFailPolicy(t *testing.T) {
+	errInit := errors.New("init failed")
+	cases := []struct {
+		name      string
+		policy    InitFailPolicy
+		retryNum  int
+		failTimes int // 每个worker前几次Init失败
+		wantFails int
+	}{
+		{"continue", InitFailContinue, 0, 1, 3},
+		{"retry succeeds", InitFailRetry, 2, 2, 0},
+		{"retry exhausted", InitFailRetry, 1, 2, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Config{ConcurrencyNum: 3, ReqNumPerConcy: 1, ResultsBufferSize: 16,
+				InitFailPolicy: c.policy, InitRetryNum: c.retryNum, InitRetryBackoffMS: 1}
+			attempts := make(chan struct{}, 100)
+			_, err := quietServer().Run(cfg, &Request{}, func() ReqHandler {
+				return &funcHandler{
+					init: func() error {
+						attempts <- struct{}{}
+						if len(attempts) <= c.failTimes*cfg.ConcurrencyNum {
+							return errInit
+						}
+						return nil
+					},
+					onRequest: func(ctx context.Context, results chan<- *Response) error { return nil },
+				}
+			})
+			fails := 0
+			var re *RunError
+			if errors.As(err, &re) {
+				fails = re.InitFailures
+			} else if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if fails != c.wantFails {
+				t.Errorf("init failures = %d, want %d (err %v)", fails, c.wantFails, err)
+			}
+		})
+	}
+}
+
+func TestAbortDuringInitRetry(t *testing.T) {
+	cfg := &Config{ConcurrencyNum: 2, ReqNumPerConcy: 1, ResultsBufferSize: 16,
+		InitFailPolicy: InitFailRetry, InitRetryNum: 5, InitRetryBackoffMS: 10000}
+	s := quietServer()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Abort()
+	}()
+	start := time.Now()
+	_, err := s.Run(cfg, &Request{}, func() ReqHandler {
+		return &funcHandler{init: func() error { return errors.New("init failed") }}
+	})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("run took %v after abort, want prompt return", elapsed)
+	}
+	if !errors.Is(err, ErrRunAborted) {
+		t.Errorf("err = %v, want ErrRunAborted", err)
+	}
+}
+
+// 只实现OnRequest的handler, 用于测试在独立goroutine中执行的调用
+type legacyHandler struct {
+	onRequest func() error
+}
+
+func (h *legacyHandler) Init(req *Request, results chan<- *Response) error { return nil }
+func (h *legacyHandler) OnRequest() error                                  { return h.onRequest() }
+func (h *legacyHandler) Close()                                            {}
+
+func TestPanicIsolation(t *testing.T) {
+	boom := func() error { panic("boom") }
+	cases := []struct {
+		name        string
+		cfg         Config
+		handler     func() ReqHandler
+		method      string // 统计panic的handler方法
+		wantPanics  int
+		wantAborted bool
+	}{
+		{"on request", Config{ReqNumPerConcy: 5},
+			func() ReqHandler {
+				return &funcHandler{onRequest: func(ctx context.Context, results chan<- *Response) error { return boom() }}
+			}, "OnRequest", 5, false},
+		{"legacy on request with timeout", Config{ReqNumPerConcy: 3, RequestTimeoutMS: 1000},
+			func() ReqHandler { return &legacyHandler{onRequest: boom} }, "OnRequest", 3, false},
+		{"init", Config{ReqNumPerConcy: 1},
+			func() ReqHandler { return &funcHandler{init: boom} }, "Init", 1, false},
+		{"max panics", Config{ReqNumPerConcy: 100, MaxPanics: 3},
+			func() ReqHandler {
+				return &funcHandler{onRequest: func(ctx context.Context, results chan<- *Response) error { return boom() }}
+			}, "OnRequest", 3, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := c.cfg
+			cfg.ConcurrencyNum, cfg.ResultsBufferSize = 1, 16
+			var logs strings.Builder
+			var mu sync.Mutex
+			s := NewServer()
+			s.RedirectLog(func(format string, a ...interface{}) (int, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return fmt.Fprintf(&logs, format, a...)
+			})
+			reports, err := s.Run(&cfg, &Request{}, c.handler)
+			if aborted := errors.Is(err, ErrRunAborted); aborted != c.wantAborted {
+				t.Errorf("err = %v, want aborted %v", err, c.wantAborted)
+			}
+			panics := 0
+			if r := findReport(reports, MSG_HANDLER, c.method); r != nil {
+				panics = r.Errors[ERR_CODE_PANIC]
+			}
+			if panics != c.wantPanics {
+				t.Errorf("%s panics = %d, want %d", c.method, panics, c.wantPanics)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !strings.Contains(logs.String(), "panic: boom") || !strings.Contains(logs.String(), "goroutine") {
+				t.Errorf("panic stack not logged:\n%s", logs.String())
+			}
+		})
+	}
+}
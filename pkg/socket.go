@@ -0,0 +1,477 @@
+package kite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSocketClosed  = errors.New("kite: socket closed")
+	ErrSocketTimeout = errors.New("kite: socket request timeout")
+	ErrSocketTooBig  = errors.New("kite: socket frame too big")
+)
+
+// 解码时单帧大小的默认上限, 防止错误的长度字段导致分配过大的内存
+const socketDefaultMaxFrameSize = 16 << 20
+
+func maxFrameSize(n int) int {
+	if n <= 0 {
+		return socketDefaultMaxFrameSize
+	}
+	return n
+}
+
+// 帧编解码接口, 请求与响应帧通过序号匹配
+type Codec interface {
+	// 将序号及消息体编码为一帧
+	Encode(seq uint32, body []byte) ([]byte, error)
+	// 从r中读取一帧, 返回序号及消息体
+	Decode(r *bufio.Reader) (seq uint32, body []byte, err error)
+}
+
+// 长度前缀: [长度][序号uint32][消息体], 长度为序号+消息体的字节数, 大端
+type LengthPrefixCodec struct {
+	LenBytes     int // 长度字段字节数, 2或4, 默认4
+	MaxFrameSize int // 解码时长度字段的上限, 默认16MB, 超出时返回ErrSocketTooBig
+}
+
+func (c LengthPrefixCodec) lenBytes() int {
+	if c.LenBytes == 2 {
+		return 2
+	}
+	return 4
+}
+
+func (c LengthPrefixCodec) Encode(seq uint32, body []byte) ([]byte, error) {
+	n := c.lenBytes()
+	size := 4 + len(body)
+	if n == 2 && size > 0xffff {
+		return nil, fmt.Errorf("frame size %d overflow", size)
+	}
+	frame := make([]byte, n+size)
+	if n == 2 {
+		binary.BigEndian.PutUint16(frame, uint16(size))
+	} else {
+		binary.BigEndian.PutUint32(frame, uint32(size))
+	}
+	binary.BigEndian.PutUint32(frame[n:], seq)
+	copy(frame[n+4:], body)
+	return frame, nil
+}
+
+func (c LengthPrefixCodec) Decode(r *bufio.Reader) (uint32, []byte, error) {
+	n := c.lenBytes()
+	hdr := make([]byte, n)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	size := 0
+	if n == 2 {
+		size = int(binary.BigEndian.Uint16(hdr))
+	} else {
+		size = int(binary.BigEndian.Uint32(hdr))
+	}
+	if size < 4 {
+		return 0, nil, fmt.Errorf("invalid frame size %d", size)
+	}
+	if size > maxFrameSize(c.MaxFrameSize) {
+		return 0, nil, ErrSocketTooBig
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(frame), frame[4:], nil
+}
+
+// 分隔符: "<序号> <消息体><分隔符>", 消息体中不能包含分隔符
+type DelimiterCodec struct {
+	Delim byte // 默认'\n'
+}
+
+func (c DelimiterCodec) delim() byte {
+	if c.Delim == 0 {
+		return '\n'
+	}
+	return c.Delim
+}
+
+func (c DelimiterCodec) Encode(seq uint32, body []byte) ([]byte, error) {
+	if bytes.IndexByte(body, c.delim()) >= 0 {
+		return nil, errors.New("body contains delimiter")
+	}
+	frame := strconv.AppendUint(nil, uint64(seq), 10)
+	frame = append(frame, ' ')
+	frame = append(frame, body...)
+	return append(frame, c.delim()), nil
+}
+
+func (c DelimiterCodec) Decode(r *bufio.Reader) (uint32, []byte, error) {
+	line, err := r.ReadBytes(c.delim())
+	if err != nil {
+		return 0, nil, err
+	}
+	line = line[:len(line)-1]
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		i = len(line)
+	}
+	seq, err := strconv.ParseUint(string(line[:i]), 10, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid frame seq: %v", err)
+	}
+	if i < len(line) {
+		i++
+	}
+	return uint32(seq), line[i:], nil
+}
+
+// 固定长度包头: 包头中指定偏移处分别为消息体长度和序号(uint32, 大端), 其余字节填Magic
+type FixedHeaderCodec struct {
+	HeaderLen int
+	LenOffset int
+	SeqOffset int
+	Magic     []byte // 包头的初始内容, 可为nil
+
+	MaxFrameSize int // 解码时消息体长度的上限, 默认16MB, 超出时返回ErrSocketTooBig
+}
+
+// 检查长度及序号字段在包头范围内且互不重叠, DialSocket时调用
+func (c FixedHeaderCodec) Validate() error {
+	if c.LenOffset < 0 || c.LenOffset+4 > c.HeaderLen {
+		return fmt.Errorf("fixed header: length field [%d, %d) out of header len %d", c.LenOffset, c.LenOffset+4, c.HeaderLen)
+	}
+	if c.SeqOffset < 0 || c.SeqOffset+4 > c.HeaderLen {
+		return fmt.Errorf("fixed header: seq field [%d, %d) out of header len %d", c.SeqOffset, c.SeqOffset+4, c.HeaderLen)
+	}
+	if c.LenOffset < c.SeqOffset+4 && c.SeqOffset < c.LenOffset+4 {
+		return fmt.Errorf("fixed header: length field at %d overlaps seq field at %d", c.LenOffset, c.SeqOffset)
+	}
+	if len(c.Magic) > c.HeaderLen {
+		return fmt.Errorf("fixed header: magic longer than header len %d", c.HeaderLen)
+	}
+	return nil
+}
+
+// 可选的Codec配置检查
+type codecValidator interface {
+	Validate() error
+}
+
+func (c FixedHeaderCodec) Encode(seq uint32, body []byte) ([]byte, error) {
+	frame := make([]byte, c.HeaderLen+len(body))
+	copy(frame, c.Magic)
+	binary.BigEndian.PutUint32(frame[c.LenOffset:], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[c.SeqOffset:], seq)
+	copy(frame[c.HeaderLen:], body)
+	return frame, nil
+}
+
+func (c FixedHeaderCodec) Decode(r *bufio.Reader) (uint32, []byte, error) {
+	hdr := make([]byte, c.HeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[c.LenOffset:])
+	if uint64(size) > uint64(maxFrameSize(c.MaxFrameSize)) {
+		return 0, nil, ErrSocketTooBig
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(hdr[c.SeqOffset:]), body, nil
+}
+
+type SocketConfig struct {
+	Network string        // tcp或udp, 默认tcp
+	Codec   Codec         // 默认LengthPrefixCodec
+	MsgType MsgType       // 统计中的消息类型, 默认MSG_TCP/MSG_UDP, 自定义类型需先RegisterMsgType
+	Method  string        // 统计中的命令字, 默认request
+	Timeout time.Duration // 连接及等待响应的超时, 默认5秒
+	// 生成该连接上第n个请求的消息体, 默认为空
+	NewMessage func(n uint32) []byte
+}
+
+func (cfg *SocketConfig) setDefaults() {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if cfg.Codec == nil {
+		cfg.Codec = LengthPrefixCodec{}
+	}
+	if cfg.MsgType == 0 {
+		cfg.MsgType = MSG_TCP
+		if cfg.Network == "udp" {
+			cfg.MsgType = MSG_UDP
+		}
+	}
+	if cfg.Method == "" {
+		cfg.Method = "request"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.NewMessage == nil {
+		cfg.NewMessage = func(n uint32) []byte { return nil }
+	}
+}
+
+// 带统计的socket连接, 按序号匹配请求与响应帧
+type SocketConn struct {
+	cfg     *SocketConfig
+	conn    net.Conn
+	results chan<- *Response
+
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	seq     uint32
+	closing bool
+	pending map[uint32]chan socketFrame
+	done    chan struct{}
+}
+
+// 收到的响应帧, size为编码后整帧的字节数, 与发送时统计的帧长度一致
+type socketFrame struct {
+	body []byte
+	size int
+}
+
+// 统计从底层连接读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func DialSocket(addr string, cfg *SocketConfig, results chan<- *Response) (*SocketConn, error) {
+	sc := *cfg
+	sc.setDefaults()
+	if v, ok := sc.Codec.(codecValidator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.DialTimeout(sc.Network, addr, sc.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &SocketConn{
+		cfg:     &sc,
+		conn:    conn,
+		results: results,
+		pending: make(map[uint32]chan socketFrame),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// 持续读取响应帧直到出错, udp每个数据报为一帧
+func (c *SocketConn) readFrames() error {
+	if c.cfg.Network != "udp" {
+		// 帧长度 = 从连接读取的字节数 - 仍在缓冲区中的字节数 的增量
+		cr := &countingReader{r: c.conn}
+		r := bufio.NewReader(cr)
+		consumed := 0
+		for {
+			seq, body, err := c.cfg.Codec.Decode(r)
+			if err != nil {
+				return err
+			}
+			n := cr.n - r.Buffered()
+			c.dispatch(seq, socketFrame{body: body, size: n - consumed})
+			consumed = n
+		}
+	}
+	buf := make([]byte, 64*1024)
+	br := bytes.NewReader(nil)
+	r := bufio.NewReader(br)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		br.Reset(buf[:n])
+		r.Reset(br)
+		seq, body, err := c.cfg.Codec.Decode(r)
+		if err != nil {
+			continue
+		}
+		// body可能引用复用的缓冲区, 下一个数据报会覆盖
+		c.dispatch(seq, socketFrame{body: append([]byte(nil), body...), size: n})
+	}
+}
+
+func (c *SocketConn) dispatch(seq uint32, frame socketFrame) {
+	c.mu.Lock()
+	ch := c.pending[seq]
+	delete(c.pending, seq)
+	c.mu.Unlock()
+	if ch != nil {
+		ch <- frame
+		return
+	}
+	// 超时后才到达或无法匹配的响应帧, 只计数不计入延迟
+	SendResponse(c.results, &Response{
+		MsgType:       c.cfg.MsgType,
+		Method:        "[UNMATCHED]" + c.cfg.Method,
+		IsSucceed:     false,
+		ErrCode:       ERR_CODE_UNMATCHED,
+		ErrMsg:        fmt.Sprintf("unmatched response frame seq %d", seq),
+		ReceivedBytes: uint64(frame.size),
+		NoLatency:     true,
+	})
+}
+
+func (c *SocketConn) readLoop() {
+	defer close(c.done)
+	readErr := c.readFrames()
+	c.mu.Lock()
+	closing := c.closing
+	c.closing = true
+	for seq, ch := range c.pending {
+		close(ch)
+		delete(c.pending, seq)
+	}
+	c.mu.Unlock()
+	if !closing {
+		SendResponse(c.results, &Response{
+			MsgType:   c.cfg.MsgType,
+			Method:    "[DISCONNECT]" + c.cfg.Method,
+			IsSucceed: false,
+			ErrCode:   ERR_CODE_REQUEST,
+			ErrMsg:    readErr.Error(),
+			NoLatency: true,
+		})
+	}
+}
+
+// 编码发送消息体并等待同序号的响应帧, 结果以Method上报
+func (c *SocketConn) Call(body []byte) ([]byte, error) {
+	return c.CallContext(context.Background(), body)
+}
+
+// 同Call, ctx结束时停止等待, ctx中的RunState填入上报的结果
+func (c *SocketConn) CallContext(ctx context.Context, body []byte) ([]byte, error) {
+	ch := make(chan socketFrame, 1)
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return nil, ErrSocketClosed
+	}
+	c.seq++
+	seq := c.seq
+	c.pending[seq] = ch
+	c.mu.Unlock()
+	frame, err := c.cfg.Codec.Encode(seq, body)
+	startTime := time.Now()
+	if err == nil {
+		c.wmu.Lock()
+		_, err = c.conn.Write(frame)
+		c.wmu.Unlock()
+	}
+	var rsp socketFrame
+	errCode := ERR_CODE_REQUEST
+	if err == nil {
+		timer := time.NewTimer(c.cfg.Timeout)
+		select {
+		case m, ok := <-ch:
+			if ok {
+				rsp = m
+			} else {
+				err = ErrSocketClosed
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			if err == context.DeadlineExceeded {
+				errCode = ERR_CODE_TIMEOUT
+			}
+		case <-timer.C:
+			err = ErrSocketTimeout
+			errCode = ERR_CODE_TIMEOUT
+		}
+		timer.Stop()
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+	}
+	result := &Response{
+		MsgType:       c.cfg.MsgType,
+		Method:        c.cfg.Method,
+		StartTime:     startTime,
+		UseTime:       uint64(time.Since(startTime)),
+		IsSucceed:     err == nil,
+		ReceivedBytes: uint64(rsp.size),
+		SentBytes:     uint64(len(frame)),
+	}
+	if err != nil {
+		result.ErrCode = errCode
+		result.ErrMsg = err.Error()
+	}
+	FillResponse(ctx, result)
+	SendResponse(c.results, result)
+	return rsp.body, err
+}
+
+func (c *SocketConn) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+type socketHandler struct {
+	cfg  *SocketConfig
+	conn *SocketConn
+	n    uint32
+}
+
+// 每个worker维持一个连接, 每次OnRequest发起一次Call, Request.Url为host:port
+func NewSocketHandler(cfg *SocketConfig) NewReqHandlerFunc {
+	cfg.setDefaults()
+	return func() ReqHandler {
+		return &socketHandler{cfg: cfg}
+	}
+}
+
+func (h *socketHandler) Init(req *Request, results chan<- *Response) error {
+	conn, err := DialSocket(req.Url, h.cfg, results)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+func (h *socketHandler) OnRequest() error {
+	return h.OnRequestContext(context.Background())
+}
+
+func (h *socketHandler) OnRequestContext(ctx context.Context) error {
+	h.n++
+	_, err := h.conn.CallContext(ctx, h.cfg.NewMessage(h.n))
+	return err
+}
+
+func (h *socketHandler) Close() {
+	h.conn.Close()
+}
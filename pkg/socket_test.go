@@ -0,0 +1,153 @@
+package kite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		codec Codec
+	}{
+		{"length prefix 4", LengthPrefixCodec{}},
+		{"length prefix 2", LengthPrefixCodec{LenBytes: 2}},
+		{"delimiter", DelimiterCodec{}},
+		{"delimiter custom", DelimiterCodec{Delim: '|'}},
+		{"fixed header", FixedHeaderCodec{HeaderLen: 12, LenOffset: 4, SeqOffset: 8, Magic: []byte{0xca, 0xfe}}},
+	}
+	bodies := [][]byte{{}, []byte("hello"), bytes.Repeat([]byte("x"), 1000)}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			for i, body := range bodies {
+				frame, err := c.codec.Encode(uint32(i+100), body)
+				if err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+				buf.Write(frame)
+			}
+			r := bufio.NewReader(&buf)
+			for i, body := range bodies {
+				seq, got, err := c.codec.Decode(r)
+				if err != nil {
+					t.Fatalf("decode frame %d: %v", i, err)
+				}
+				if seq != uint32(i+100) || !bytes.Equal(got, body) {
+					t.Errorf("frame %d = (%d, %q), want (%d, %q)", i, seq, got, i+100, body)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecEncodeError(t *testing.T) {
+	cases := []struct {
+		name  string
+		codec Codec
+		body  []byte
+	}{
+		{"length prefix 2 overflow", LengthPrefixCodec{LenBytes: 2}, make([]byte, 0xffff)},
+		{"delimiter in body", DelimiterCodec{}, []byte("a\nb")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := c.codec.Encode(1, c.body); err == nil {
+				t.Error("encode succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestCodecDecodeFrameSize(t *testing.T) {
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	fixedHdr := func(size uint32) []byte {
+		hdr := make([]byte, 8)
+		copy(hdr, u32(size))
+		copy(hdr[4:], u32(1))
+		return hdr
+	}
+	cases := []struct {
+		name    string
+		codec   Codec
+		input   []byte
+		wantErr error // nil时只要求出错
+	}{
+		{"length prefix too small", LengthPrefixCodec{}, u32(3), nil},
+		{"length prefix over limit", LengthPrefixCodec{MaxFrameSize: 64}, u32(65), ErrSocketTooBig},
+		{"length prefix over default", LengthPrefixCodec{}, u32(0xffffffff), ErrSocketTooBig},
+		{"fixed header over limit", FixedHeaderCodec{HeaderLen: 8, SeqOffset: 4, MaxFrameSize: 64}, fixedHdr(65), ErrSocketTooBig},
+		{"fixed header over default", FixedHeaderCodec{HeaderLen: 8, SeqOffset: 4}, fixedHdr(0xffffffff), ErrSocketTooBig},
+		{"delimiter bad seq", DelimiterCodec{}, []byte("abc body\n"), nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := c.codec.Decode(bufio.NewReader(bytes.NewReader(c.input)))
+			if err == nil || (c.wantErr != nil && err != c.wantErr) {
+				t.Errorf("decode err = %v, want %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestFixedHeaderValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		codec FixedHeaderCodec
+		ok    bool
+	}{
+		{"valid", FixedHeaderCodec{HeaderLen: 8, LenOffset: 0, SeqOffset: 4}, true},
+		{"length out of header", FixedHeaderCodec{HeaderLen: 8, LenOffset: 6, SeqOffset: 0}, false},
+		{"seq out of header", FixedHeaderCodec{HeaderLen: 8, LenOffset: 0, SeqOffset: 5}, false},
+		{"overlap", FixedHeaderCodec{HeaderLen: 8, LenOffset: 0, SeqOffset: 2}, false},
+		{"magic too long", FixedHeaderCodec{HeaderLen: 8, SeqOffset: 4, Magic: make([]byte, 9)}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.codec.Validate(); (err == nil) != c.ok {
+				t.Errorf("validate err = %v, want ok %v", err, c.ok)
+			}
+		})
+	}
+}
+
+// 对端发来超长的长度字段时断开连接, 断开只计数不计入延迟
+func TestSocketDisconnectOnOversizeFrame(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte{0x7f, 0xff, 0xff, 0xff})
+		time.Sleep(time.Second)
+	}()
+
+	results := make(chan *Response, 1)
+	c, err := DialSocket(ln.Addr().String(), &SocketConfig{Codec: LengthPrefixCodec{MaxFrameSize: 1024}}, results)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	select {
+	case result := <-results:
+		if result.Method != "[DISCONNECT]request" || result.IsSucceed || !result.NoLatency || result.ErrMsg != ErrSocketTooBig.Error() {
+			t.Errorf("result = %+v, want DISCONNECT without latency", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no disconnect result")
+	}
+}
@@ -3,28 +3,56 @@ package kite
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"time"
 )
 
 type Header struct {
 	MsgType MsgType
 	Method  string
+	Tags    string // 按Config.GroupBy拼接的标签维度, 如region=sh,tenant=a
+}
+
+// 统计项标题: 消息类型 | 命令字 [| 标签]
+func (h Header) Title() string {
+	if h.Tags == "" {
+		return fmt.Sprintf("%s | %s", h.MsgType, h.Method)
+	}
+	return fmt.Sprintf("%s | %s | %s", h.MsgType, h.Method, h.Tags)
 }
 
 type Report struct {
 	Header
-	TotalUseSec  float64 // 总时长
-	ConcyNum     int     // 并行数
-	SuccessNum   uint64
-	FailureNum   uint64
-	QPS          float64
-	MaxLatencyMS float64   // 最大延迟
-	MinLatencyMS float64   // 最小延迟
-	AvgLatencyMS float64   // 平均延迟
-	LoadBytes    uint64    // 下载字节数
-	LoadSpeed    int64     // 下载速度 bytes/second
-	Latencies    []float64 // 升序延迟记录
-	Errors       ErrCodes  // 错误码统计
+	TotalUseSec   float64 // 总时长
+	ConcyNum      int     // 并行数
+	SuccessNum    uint64
+	FailureNum    uint64
+	QPS           float64
+	MaxLatencyMS  float64          // 最大延迟
+	MinLatencyMS  float64          // 最小延迟
+	AvgLatencyMS  float64          // 平均延迟
+	LoadBytes     uint64           // 下载字节数
+	LoadSpeed     int64            // 下载速度 bytes/second
+	UploadBytes   uint64           // 上传字节数
+	UploadSpeed   int64            // 上传速度 bytes/second
+	Latencies     []float64        // 升序延迟记录
+	Errors        ErrCodes         // 错误码统计
+	ErrSamples    []ErrSample      // 各错误码下不同错误信息的样本
+	Checks        []CheckStats     // 各响应检查的通过情况
+	Timeline      []TimePoint      // 按采样间隔统计的时间序列
+	Health        *GeneratorHealth // 压测端自身健康状况, 运行级统计, 各Report共享
+	Retry         *RetryStats      // 调度器视角的请求及重试统计, 运行级统计, 未配置重试时为nil
+	Pacing        *PacingStats     // 思考时间及固定节奏统计, 运行级统计, 未配置时为nil
+	WarmupNum     uint64           // 预热期间排除的结果数
+	WarmupFailNum uint64           // 其中失败的结果数
+	WarmupSec     float64          // 预热时长
+	FirstSuccess  uint64           // 首次尝试成功数
+	FirstFailure  uint64           // 首次尝试失败数
+	RetryNum      uint64           // 重试的结果数
+	RetrySuccess  uint64           // 重试成功数
+
+	percentiles []float64
+	histogram   *HistogramConfig
 }
 
 func (r *Report) GenerateReport(data *StatisticData) {
@@ -53,75 +81,221 @@ func (r *Report) GenerateReport(data *StatisticData) {
 	if r.TotalUseSec > 0 {
 		r.LoadSpeed = int64(float64(data.receivedBytes) / r.TotalUseSec)
 	}
+	r.UploadBytes = data.sentBytes
+	if r.TotalUseSec > 0 {
+		r.UploadSpeed = int64(float64(data.sentBytes) / r.TotalUseSec)
+	}
 	r.Errors = data.errors
+	r.ErrSamples = data.errSamples.snapshot()
+	for i := range r.ErrSamples {
+		r.ErrSamples[i].Name = ErrCodeName(r.MsgType, r.ErrSamples[i].ErrCode)
+	}
+	r.Checks = data.checks.snapshot()
+	r.Timeline = data.timeline
+	r.FirstSuccess = data.firstSuccess
+	r.FirstFailure = data.firstFailure
+	r.RetryNum = data.retryNum
+	r.RetrySuccess = data.retrySuccess
+	r.WarmupNum = data.warmupNum
+	r.WarmupFailNum = data.warmupFailNum
+	r.WarmupSec = data.warmupSec
 }
 
 func (r *Report) GenerateHistogram() []LatencyBucket {
-	return GenerateHistogram(r.Latencies, r.MaxLatencyMS, r.MinLatencyMS)
+	return GenerateHistogramWithConfig(r.Latencies, r.MaxLatencyMS, r.MinLatencyMS, r.histogram)
 }
 
 func (r *Report) GenerateDistribution() []LatencyDistribution {
-	return GenerateLatencies(r.Latencies)
+	return GeneratePercentiles(r.Latencies, r.percentiles)
 }
 
 func (r *Report) OutputReport(logfn LogFunc, logHead string) {
-	logfn("%s=======>消息类型|命令字 : %s | %s\n", logHead, r.MsgType, r.Method)
-	logfn("─────┬───────┬───────┬───────┬────────┬────────┬────────┬────────┬────────┬────────┬────────\n")
-	logfn(" 耗时│ 并发数│ 成功数│ 失败数│   qps  │最长耗时│最短耗时│平均耗时│下载字节│字节每秒│ 错误码\n")
-	logfn("─────┼───────┼───────┼───────┼────────┼────────┼────────┼────────┼────────┼────────┼────────\n")
-	logfn(fmt.Sprintf("%4.0fs│%7d│%7d│%7d│%8.2f│%6.2fms│%6.2fms│%6.2fms│%8s|%8s│%s\n",
+	logfn("%s=======>消息类型|命令字 : %s\n", logHead, r.Title())
+	logfn("─────┬───────┬───────┬───────┬────────┬────────┬────────┬────────┬────────┬────────┬────────┬────────┬────────\n")
+	logfn(" 耗时│ 并发数│ 成功数│ 失败数│   qps  │最长耗时│最短耗时│平均耗时│下载字节│字节每秒│上传字节│字节每秒│ 错误码\n")
+	logfn("─────┼───────┼───────┼───────┼────────┼────────┼────────┼────────┼────────┼────────┼────────┼────────┼────────\n")
+	logfn("%4.0fs│%7d│%7d│%7d│%8.2f│%6.2fms│%6.2fms│%6.2fms│%8s|%8s│%8s│%8s│%s\n",
 		r.TotalUseSec, r.ConcyNum, r.SuccessNum, r.FailureNum, r.QPS, r.MaxLatencyMS, r.MinLatencyMS, r.AvgLatencyMS,
 		fmt.Sprintf("%dB", r.LoadBytes),
 		fmt.Sprintf("%dB/s", r.LoadSpeed),
-		r.Errors))
+		fmt.Sprintf("%dB", r.UploadBytes),
+		fmt.Sprintf("%dB/s", r.UploadSpeed),
+		r.Errors.Format(r.MsgType))
+	if len(r.ErrSamples) > 0 {
+		logfn("Error messages:\n")
+		for _, e := range r.ErrSamples {
+			code := fmt.Sprint(e.ErrCode)
+			if e.Name != "" {
+				code += "(" + e.Name + ")"
+			}
+			logfn("%20s│%7d│ %s ~ %s │ %s\n", code, e.Count,
+				e.FirstSeen.Format("15:04:05.000"), e.LastSeen.Format("15:04:05.000"), e.Message)
+		}
+	}
+	if len(r.Checks) > 0 {
+		logfn("Checks:\n")
+		for _, c := range r.Checks {
+			logfn("%7.2f%%│%7d│%7d│ %s\n", c.PassRate(), c.Passed, c.Failed, c.Name)
+		}
+	}
+	if r.WarmupNum > 0 {
+		logfn("Warm-up: 预热%.1fs, 排除%d条结果(失败%d), 以上统计仅含稳定阶段\n", r.WarmupSec, r.WarmupNum, r.WarmupFailNum)
+	}
 	logfn("Latency histogram:\n")
 	for _, h := range r.GenerateHistogram() {
 		logfn("%8.2fms|%7d|%8.2f%%\n", h.Mark, h.Count, h.Frequency*100)
 	}
 	logfn("Latency distribution:\n")
 	for _, d := range r.GenerateDistribution() {
-		logfn("%7d%%     in %8.2fms\n", d.Percentage, d.Latency)
+		logfn("%7s%%     in %8.2fms\n", strconv.FormatFloat(d.Percentile, 'f', -1, 64), d.Latency)
 	}
 }
 
 type StatisticData struct {
 	Header
-	logHead       string    // 日志标识
-	requestTime   uint64    // 请求总时间
-	successNum    uint64    // 成功处理数，code为0
-	failureNum    uint64    // 处理失败数，code不为0
-	receivedBytes uint64    // 收包量
-	latencies     []float64 // 每个包处理时长
-	errors        ErrCodes  // 错误码统计
+	logHead       string       // 日志标识
+	requestTime   uint64       // 请求总时间
+	successNum    uint64       // 成功处理数，code为0
+	failureNum    uint64       // 处理失败数，code不为0
+	receivedBytes uint64       // 收包量
+	sentBytes     uint64       // 发包量
+	latencies     []float64    // 每个包处理时长
+	errors        ErrCodes     // 错误码统计
+	errSamples    *errSampler  // 错误信息样本
+	checks        checkCounter // 响应检查统计
+	slot          *timeSlot    // 当前采样槽
+	timeline      []TimePoint  // 已结束的采样点
+	dashMark      int          // 实时面板上次统计到的latencies位置
+	dashSuccess   uint64       // 实时面板上次统计时的成功数
+	firstSuccess  uint64       // 首次尝试成功数
+	firstFailure  uint64       // 首次尝试失败数
+	retryNum      uint64       // 重试的结果数
+	retrySuccess  uint64       // 重试成功数
+	warmupNum     uint64       // 预热期间排除的结果数
+	warmupFailNum uint64       // 预热期间排除的失败结果数
+	warmupSec     float64      // 预热时长
+	keepSlots     bool         // 采样点保留区间内的延迟记录
+}
+
+// 时间序列采样槽, 结束时汇总成TimePoint
+type timeSlot struct {
+	index      int
+	successNum uint64
+	failureNum uint64
+	latencies  []float64
+}
+
+func (t *timeSlot) point(interval time.Duration) TimePoint {
+	sec := interval.Seconds()
+	p := TimePoint{
+		OffsetSec:  float64(t.index) * sec,
+		SuccessNum: t.successNum,
+		FailureNum: t.failureNum,
+		QPS:        float64(t.successNum) / sec,
+	}
+	if len(t.latencies) > 0 {
+		sort.Float64s(t.latencies)
+		sum := float64(0)
+		for _, latency := range t.latencies {
+			sum += latency
+		}
+		p.AvgLatencyMS = sum / float64(len(t.latencies))
+		p.P50LatencyMS = percentileOf(t.latencies, 50)
+		p.P99LatencyMS = percentileOf(t.latencies, 99)
+		p.MaxLatencyMS = t.latencies[len(t.latencies)-1]
+	}
+	return p
+}
+
+// 推进采样槽到index, 中间没有数据的采样点补零
+func (d *StatisticData) advanceSlot(index int, interval time.Duration) {
+	if d.slot != nil && d.slot.index == index {
+		return
+	}
+	next := 0
+	if d.slot != nil {
+		d.appendPoint(d.slot, interval)
+		next = d.slot.index + 1
+	}
+	for ; next < index; next++ {
+		d.appendPoint(&timeSlot{index: next}, interval)
+	}
+	d.slot = &timeSlot{index: index}
+}
+
+// 结束当前采样槽
+func (d *StatisticData) flushSlot(interval time.Duration) {
+	if d.slot != nil {
+		d.appendPoint(d.slot, interval)
+		d.slot = nil
+	}
+}
+
+func (d *StatisticData) appendPoint(t *timeSlot, interval time.Duration) {
+	p := t.point(interval)
+	if d.keepSlots {
+		p.latencies = t.latencies
+	}
+	d.timeline = append(d.timeline, p)
 }
 
 type Statistician struct {
 	config     *Config
 	logfn      LogFunc
+	interval   time.Duration  // 时间序列采样间隔
+	dash       *dashboard     // 终端实时面板, 可为nil
+	health     *healthMonitor // 压测端健康监控, 可为nil
+	retries    *retryCounter  // 调度器的重试统计, 可为nil
+	pacing     *pacingCounter // 迭代节奏统计, 可为nil
+	stage      bool           // 容量搜索的阶段: 不输出统计表, 时间序列保留各区间的延迟记录
 	statistics map[Header]*StatisticData
 	reports    map[Header]*Report
+	other      *Header // 超出MaxReportNum后合并的统计项, 首次超出时生成
 }
 
 func (s *Statistician) Start(results <-chan *Response, done chan<- []*Report) {
 	s.statistics = make(map[Header]*StatisticData)
 	s.reports = make(map[Header]*Report)
-	logCh := make(chan *StatisticData, 256)
+	s.other = nil
+	// 每轮Tick及最终统计为一批, 各统计项输出后再输出一次运行级统计
+	logCh := make(chan []*StatisticData, 16)
 	logDone := make(chan struct{})
 	logNo := 0 // 日志流水号，每轮Tick统计自增
 
 	go func() {
-		for data := range logCh {
-			s.LogReport(data)
+		for batch := range logCh {
+			for _, data := range batch {
+				s.LogReport(data)
+			}
+			if len(batch) > 0 {
+				s.outputRunStats(batch[0].logHead)
+			}
 		}
 		close(logDone)
 	}()
 
 	d := time.Duration(1<<63 - 1)
+	s.interval = time.Second
 	if s.config.StatFreqSec > 0 {
-		d = time.Duration(s.config.StatFreqSec) * time.Second
+		s.interval = time.Duration(s.config.StatFreqSec) * time.Second
+		// 实时面板开启时不再定期输出统计表
+		if s.dash == nil {
+			d = s.interval
+		}
 	}
 	ticker := time.NewTicker(d)
+	var dashTick <-chan time.Time
+	if s.dash != nil {
+		dashTicker := time.NewTicker(time.Second)
+		defer dashTicker.Stop()
+		dashTick = dashTicker.C
+	}
+	dashTime := time.Now()
 	statTime := uint64(time.Now().UnixNano())
+	warmupStart := time.Now()
+	warming := s.config.WarmupSec > 0 || s.config.WarmupReqNum > 0
+	warmupNum := 0
+	warmupSec := float64(0)
 	for {
 		select {
 		case data, actived := <-results:
@@ -129,34 +303,95 @@ func (s *Statistician) Start(results <-chan *Response, done chan<- []*Report) {
 			if !actived || data == nil {
 				goto exitTag
 			}
-			header := Header{
-				MsgType: data.MsgType,
-				Method:  data.Method,
-			}
+			header := s.header(data)
 			if s.statistics[header] == nil {
 				s.statistics[header] = &StatisticData{
 					Header:    header,
 					latencies: make([]float64, 0, 256),
 					errors:    make(ErrCodes),
+					keepSlots: s.stage,
 				}
 			}
 			stat := s.statistics[header]
+			// 预热期间的结果只计数, 预热结束后从该时刻重新计时
+			if warming {
+				now := time.Now()
+				if s.warmupDone(now.Sub(warmupStart), warmupNum) {
+					warming = false
+					warmupSec = now.Sub(warmupStart).Seconds()
+					statTime = uint64(now.UnixNano())
+					s.endWarmup()
+				} else {
+					warmupNum++
+					stat.warmupNum++
+					if !data.IsSucceed {
+						stat.warmupFailNum++
+					}
+					continue
+				}
+			}
 			// 纳秒=>毫秒
-			stat.latencies = append(stat.latencies, float64(data.UseTime)/1e6)
+			if !data.NoLatency {
+				stat.latencies = append(stat.latencies, float64(data.UseTime)/1e6)
+			}
 			// 是否请求成功
 			if data.IsSucceed == true {
 				stat.successNum = stat.successNum + 1
 			} else {
 				stat.failureNum = stat.failureNum + 1
 			}
+			// 首次尝试与重试
+			if data.Attempt > 1 {
+				stat.retryNum++
+				if data.IsSucceed {
+					stat.retrySuccess++
+				}
+			} else if data.IsSucceed {
+				stat.firstSuccess++
+			} else {
+				stat.firstFailure++
+			}
 			// 统计错误码
 			stat.errors[data.ErrCode] = stat.errors[data.ErrCode] + 1
+			if !data.IsSucceed && data.ErrMsg != "" {
+				if stat.errSamples == nil {
+					stat.errSamples = newErrSampler(s.config.ErrSampleNum)
+				}
+				stat.errSamples.add(data.ErrCode, data.ErrMsg, time.Now())
+			}
+			if len(data.Checks) > 0 {
+				if stat.checks == nil {
+					stat.checks = make(checkCounter)
+				}
+				stat.checks.add(data.Checks)
+			}
 			// 收包量
 			stat.receivedBytes += data.ReceivedBytes
+			// 发包量
+			stat.sentBytes += data.SentBytes
+			// 时间序列
+			stat.advanceSlot(s.slotIndex(data, statTime, stat.slot), s.interval)
+			if !data.NoLatency {
+				stat.slot.latencies = append(stat.slot.latencies, float64(data.UseTime)/1e6)
+			}
+			if data.IsSucceed {
+				stat.slot.successNum++
+			} else {
+				stat.slot.failureNum++
+			}
+		case now := <-dashTick:
+			s.dash.update(s.dashSnapshots(now.Sub(dashTime)))
+			dashTime = now
 		case <-ticker.C:
 			endTime := uint64(time.Now().UnixNano())
 			requestTime := endTime - statTime
 			logNo++
+			// 预热尚未结束时为已预热的时长
+			tickWarmupSec := warmupSec
+			if warming {
+				tickWarmupSec = time.Since(warmupStart).Seconds()
+			}
+			batch := make([]*StatisticData, 0, len(s.statistics))
 			for header, stat := range s.statistics {
 				lastLatencies := make([]float64, len(stat.latencies))
 				copy(lastLatencies, stat.latencies)
@@ -164,28 +399,51 @@ func (s *Statistician) Start(results <-chan *Response, done chan<- []*Report) {
 				for errCode, num := range stat.errors {
 					lastErrors[errCode] = num
 				}
-				logCh <- &StatisticData{
+				batch = append(batch, &StatisticData{
 					Header:        header,
 					logHead:       fmt.Sprintf("[TickNo:%d]", logNo),
 					requestTime:   requestTime,
 					successNum:    stat.successNum,
 					failureNum:    stat.failureNum,
 					receivedBytes: stat.receivedBytes,
+					sentBytes:     stat.sentBytes,
 					latencies:     lastLatencies,
 					errors:        lastErrors,
-				}
+					errSamples:    stat.errSamples.clone(),
+					checks:        stat.checks.clone(),
+					timeline:      append([]TimePoint(nil), stat.timeline...),
+					firstSuccess:  stat.firstSuccess,
+					firstFailure:  stat.firstFailure,
+					retryNum:      stat.retryNum,
+					retrySuccess:  stat.retrySuccess,
+					warmupNum:     stat.warmupNum,
+					warmupFailNum: stat.warmupFailNum,
+					warmupSec:     tickWarmupSec,
+				})
 			}
+			logCh <- batch
 		}
 	}
 
 exitTag:
+	if s.dash != nil {
+		s.dash.stop()
+	}
+	if warming {
+		// 运行在预热期间结束, 没有稳定阶段的数据
+		warmupSec = time.Since(warmupStart).Seconds()
+	}
 	endTime := uint64(time.Now().UnixNano())
 	requestTime := endTime - statTime
+	batch := make([]*StatisticData, 0, len(s.statistics))
 	for _, stat := range s.statistics {
 		stat.logHead = "[Finally]"
 		stat.requestTime = requestTime
-		logCh <- stat
+		stat.warmupSec = warmupSec
+		stat.flushSlot(s.interval)
+		batch = append(batch, stat)
 	}
+	logCh <- batch
 
 	ticker.Stop()
 	close(logCh)
@@ -197,14 +455,104 @@ exitTag:
 	done <- reports
 }
 
+// 按结果的结束时间(StartTime+UseTime)计算采样槽, 早于当前槽的迟到结果归入当前槽
+func (s *Statistician) slotIndex(data *Response, statTime uint64, cur *timeSlot) int {
+	end := uint64(time.Now().UnixNano())
+	if !data.StartTime.IsZero() {
+		end = uint64(data.StartTime.UnixNano()) + data.UseTime
+	}
+	index := 0
+	if end > statTime {
+		index = int((end - statTime) / uint64(s.interval))
+	}
+	if cur != nil && index < cur.index {
+		index = cur.index
+	}
+	return index
+}
+
+// 预热结束时运行级统计(重试, 节奏, 压测端健康状况)同样从此刻开始
+func (s *Statistician) endWarmup() {
+	if s.retries != nil {
+		s.retries.endWarmup()
+	}
+	if s.pacing != nil {
+		s.pacing.endWarmup()
+	}
+	if s.health != nil {
+		s.health.endWarmup()
+	}
+}
+
+// 预热是否结束: 已达到WarmupSec且已收到WarmupReqNum条结果
+func (s *Statistician) warmupDone(elapsed time.Duration, num int) bool {
+	return elapsed >= time.Duration(s.config.WarmupSec)*time.Second && num >= s.config.WarmupReqNum
+}
+
+// 统计上次刷新实时面板以来的区间数据
+func (s *Statistician) dashSnapshots(elapsed time.Duration) []*dashSnapshot {
+	snapshots := make([]*dashSnapshot, 0, len(s.statistics))
+	for header, stat := range s.statistics {
+		interval := append([]float64(nil), stat.latencies[stat.dashMark:]...)
+		sort.Float64s(interval)
+		errors := make(ErrCodes, len(stat.errors))
+		for errCode, num := range stat.errors {
+			errors[errCode] = num
+		}
+		snapshots = append(snapshots, &dashSnapshot{
+			Header:     header,
+			qps:        float64(stat.successNum-stat.dashSuccess) / elapsed.Seconds(),
+			p50:        percentileOf(interval, 50),
+			p90:        percentileOf(interval, 90),
+			p99:        percentileOf(interval, 99),
+			successNum: stat.successNum,
+			failureNum: stat.failureNum,
+			errors:     errors,
+		})
+		stat.dashMark = len(stat.latencies)
+		stat.dashSuccess = stat.successNum
+	}
+	return snapshots
+}
+
 func (s *Statistician) LogReport(data *StatisticData) {
 	if s.reports[data.Header] == nil {
 		s.reports[data.Header] = &Report{
-			Header:   data.Header,
-			ConcyNum: s.config.ConcurrencyNum,
+			Header:      data.Header,
+			ConcyNum:    s.config.ConcurrencyNum,
+			percentiles: s.config.Percentiles,
+			histogram:   s.config.Histogram,
 		}
 	}
 	report := s.reports[data.Header]
 	report.GenerateReport(data)
-	report.OutputReport(s.logfn, data.logHead)
+	if s.health != nil {
+		report.Health = s.health.snapshot()
+	}
+	if s.retries != nil {
+		report.Retry = s.retries.snapshot()
+	}
+	if s.pacing != nil {
+		report.Pacing = s.pacing.snapshot(s.config)
+	}
+	if !s.stage {
+		report.OutputReport(s.logfn, data.logHead)
+	}
+}
+
+// 输出运行级统计(重试, 节奏, 压测端健康状况), 每批统计项之后输出一次
+func (s *Statistician) outputRunStats(logHead string) {
+	if s.stage || (s.retries == nil && s.pacing == nil && s.health == nil) {
+		return
+	}
+	s.logfn("%s=======>运行统计\n", logHead)
+	if s.retries != nil {
+		s.retries.snapshot().Output(s.logfn)
+	}
+	if s.pacing != nil {
+		s.pacing.snapshot(s.config).Output(s.logfn)
+	}
+	if s.health != nil {
+		s.health.snapshot().Output(s.logfn)
+	}
 }
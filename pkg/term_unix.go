@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package kite
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// 通过stty切换终端到逐字符输入模式, 返回恢复函数
+// 切换成功时读取最多等待0.1秒(min 0 time 1), 无输入时返回0字节, 读按键的goroutine可及时退出
+func enterRawMode() (restore func(), polling bool) {
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = os.Stdin
+	saved, err := cmd.Output()
+	if err != nil {
+		return func() {}, false
+	}
+	cmd = exec.Command("stty", "cbreak", "-echo", "min", "0", "time", "1")
+	cmd.Stdin = os.Stdin
+	if cmd.Run() != nil {
+		return func() {}, false
+	}
+	return func() {
+		cmd := exec.Command("stty", strings.TrimSpace(string(saved)))
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}, true
+}
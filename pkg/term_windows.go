@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package kite
+
+// windows下保持行输入模式, 按键后需回车
+// 读取阻塞, 面板停止后读按键的goroutine留到下一次输入(该输入被丢弃)才退出
+func enterRawMode() (restore func(), polling bool) {
+	return func() {}, false
+}
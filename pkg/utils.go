@@ -3,8 +3,11 @@ package kite
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"io/ioutil"
@@ -26,6 +29,7 @@ func GRPCClientInterceptor(results chan<- *Response, filter func(result *Respons
 		startTime := time.Now()
 		err := invoker(ctx, fullMethod, req, rsp, cc, opts...)
 		result := &Response{}
+		result.StartTime = startTime
 		result.UseTime = uint64(time.Since(startTime))
 		result.Method = fullMethod
 		result.MsgType = MSG_GRPC
@@ -35,13 +39,19 @@ func GRPCClientInterceptor(results chan<- *Response, filter func(result *Respons
 			result.ErrCode = 0
 		} else {
 			result.IsSucceed = false
-			result.ErrCode = -1001
+			result.ErrCode = ERR_CODE_REQUEST
+			if ctx.Err() == context.DeadlineExceeded {
+				result.ErrCode = ERR_CODE_TIMEOUT
+			}
+			result.ErrMsg = err.Error()
 		}
 		result.ReceivedBytes = uint64(pbMessageInfo.Size(rsp.(proto.Message)))
+		result.SentBytes = uint64(pbMessageInfo.Size(req.(proto.Message)))
 		if filter != nil {
 			filter(result, req, rsp, err)
 		}
-		results <- result
+		FillResponse(ctx, result)
+		SendResponse(results, result)
 		return err
 	}
 }
@@ -54,16 +64,27 @@ func (f HTTPRoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error)
 
 func HTTPClientInterceptor(results chan<- *Response, rt http.RoundTripper, filter func(result *Response, req *http.Request, rsp *http.Response, err error)) http.RoundTripper {
 	return HTTPRoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		// 请求体长度未知时统计传输层实际读取的字节数, 读取失败由RoundTrip返回错误上报
+		var body *countingBody
+		if req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
 		startTime := time.Now()
 		rsp, err := rt.RoundTrip(req)
+		sentBytes := httpRequestSize(req)
+		if body != nil {
+			sentBytes += uint64(atomic.LoadInt64(&body.n))
+		}
 		result := &Response{}
+		result.StartTime = startTime
 		result.UseTime = uint64(time.Since(startTime))
-		result.Method = fmt.Sprintf("[%s]/%s", req.Method, req.URL.String())
+		result.Method = httpMethod(req.Method, req.URL)
 		result.MsgType = MSG_HTTP
-		var body []byte
+		var rspBody []byte
 		if err == nil || rsp != nil {
-			body, err = ioutil.ReadAll(rsp.Body)
-			rsp.Body = ioutil.NopCloser(bytes.NewReader(body))
+			rspBody, err = ioutil.ReadAll(rsp.Body)
+			rsp.Body = ioutil.NopCloser(bytes.NewReader(rspBody))
 		}
 		// 这一部分业务侧可通过filter灵活适配
 		if err == nil {
@@ -71,26 +92,126 @@ func HTTPClientInterceptor(results chan<- *Response, rt http.RoundTripper, filte
 			result.ErrCode = 200
 		} else {
 			result.IsSucceed = false
-			result.ErrCode = -1001
+			result.ErrCode = ERR_CODE_REQUEST
+			if req.Context().Err() == context.DeadlineExceeded {
+				result.ErrCode = ERR_CODE_TIMEOUT
+			}
+			result.ErrMsg = err.Error()
 		}
-		result.ReceivedBytes = uint64(len(body))
+		result.ReceivedBytes = uint64(len(rspBody))
+		result.SentBytes = sentBytes
 		if filter != nil {
 			filter(result, req, rsp, err)
 		}
-		results <- result
+		// filter判定为失败时以响应状态作为错误信息
+		if !result.IsSucceed && result.ErrMsg == "" && rsp != nil {
+			result.ErrMsg = rsp.Status
+		}
+		FillResponse(req.Context(), result)
+		SendResponse(results, result)
 		return rsp, err
 	})
 }
 
+// 统计已读取字节数的请求体, 传输层可能在其他协程中读取
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// 估算http请求发送的字节数: 请求行+请求头+请求体, 不含传输层自动添加的头
+func httpRequestSize(req *http.Request) uint64 {
+	size := len(req.Method) + 1 + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n")
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	size += len("Host: \r\n") + len(host)
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			size += len(k) + len(": \r\n") + len(v)
+		}
+	}
+	size += len("\r\n")
+	if req.ContentLength > 0 {
+		size += int(req.ContentLength)
+	}
+	return uint64(size)
+}
+
+// 默认的输出百分位
+var DefaultPercentiles = []float64{10, 25, 50, 75, 90, 95, 99}
+
 func GenerateHistogram(latencies []float64, slowest, fastest float64) []LatencyBucket {
+	return GenerateHistogramWithConfig(latencies, slowest, fastest, nil)
+}
+
+// 按cfg划分的桶边界(毫秒, 升序), 最后一个边界不小于slowest
+func histogramMarks(slowest, fastest float64, cfg *HistogramConfig) []float64 {
 	bc := 10
-	buckets := make([]float64, bc+1)
-	counts := make([]int, bc+1)
-	bs := (slowest - fastest) / float64(bc)
-	for i := 0; i < bc; i++ {
-		buckets[i] = fastest + bs*float64(i)
+	mode := HistogramLinear
+	factor := float64(2)
+	if cfg != nil {
+		mode = cfg.Mode
+		if cfg.BucketNum > 0 {
+			bc = cfg.BucketNum
+		}
+		if cfg.Factor > 1 {
+			factor = cfg.Factor
+		}
 	}
-	buckets[bc] = slowest
+	marks := make([]float64, bc+1)
+	switch mode {
+	case HistogramExplicit:
+		marks = append([]float64(nil), cfg.Bounds...)
+		sort.Float64s(marks)
+		if len(marks) == 0 || marks[len(marks)-1] < slowest {
+			marks = append(marks, slowest)
+		}
+		return marks
+	case HistogramLog:
+		// 桶边界在对数刻度上等距
+		low := fastest
+		if low <= 0 {
+			low = 0.001
+		}
+		ratio := slowest / low
+		if ratio < 1 {
+			ratio = 1
+		}
+		for i := 0; i < bc; i++ {
+			marks[i] = low * math.Pow(ratio, float64(i)/float64(bc))
+		}
+	case HistogramExp:
+		// 桶宽度按factor倍增
+		width := (slowest - fastest) * (factor - 1) / (math.Pow(factor, float64(bc)) - 1)
+		marks[0] = fastest
+		for i := 1; i < bc; i++ {
+			marks[i] = marks[i-1] + width*math.Pow(factor, float64(i-1))
+		}
+	default:
+		bs := (slowest - fastest) / float64(bc)
+		for i := 0; i < bc; i++ {
+			marks[i] = fastest + bs*float64(i)
+		}
+	}
+	marks[bc] = slowest
+	return marks
+}
+
+// 按cfg划分桶的延迟直方图, cfg为nil时为10个等宽桶
+func GenerateHistogramWithConfig(latencies []float64, slowest, fastest float64, cfg *HistogramConfig) []LatencyBucket {
+	if len(latencies) == 0 {
+		return nil
+	}
+	buckets := histogramMarks(slowest, fastest, cfg)
+	counts := make([]int, len(buckets))
 	var bi int
 	for i := 0; i < len(latencies); {
 		if latencies[i] <= buckets[bi] {
@@ -98,6 +219,10 @@ func GenerateHistogram(latencies []float64, slowest, fastest float64) []LatencyB
 			counts[bi]++
 		} else if bi < len(buckets)-1 {
 			bi++
+		} else {
+			// 超出最后一个边界的计入最后一个桶
+			i++
+			counts[bi]++
 		}
 	}
 	res := make([]LatencyBucket, len(buckets))
@@ -112,29 +237,44 @@ func GenerateHistogram(latencies []float64, slowest, fastest float64) []LatencyB
 }
 
 func GenerateLatencies(latencies []float64) []LatencyDistribution {
+	return GeneratePercentiles(latencies, nil)
+}
+
+// 升序延迟数组的百分位分布, pctls为nil时使用DefaultPercentiles
+func GeneratePercentiles(latencies []float64, pctls []float64) []LatencyDistribution {
 	if len(latencies) == 0 {
 		return nil
 	}
-	pctls := []int{10, 25, 50, 75, 90, 95, 99}
+	if len(pctls) == 0 {
+		pctls = DefaultPercentiles
+	}
 	data := make([]float64, len(pctls))
-	lt := len(latencies)
 	for i, p := range pctls {
-		fi := float64(p*lt) / float64(100.0)
-		ii := int(fi)
-		if ii >= lt || float64(ii) == fi {
-			ii = ii - 1
-		}
-		if ii < 0 {
-			ii = 0
-		}
-		data[i] = latencies[ii]
+		data[i] = percentileOf(latencies, p)
 	}
 
 	res := make([]LatencyDistribution, len(pctls))
 	for i := 0; i < len(pctls); i++ {
 		if data[i] > 0 {
-			res[i] = LatencyDistribution{Percentage: pctls[i], Latency: data[i]}
+			res[i] = LatencyDistribution{Percentage: int(pctls[i]), Percentile: pctls[i], Latency: data[i]}
 		}
 	}
 	return res
 }
+
+// 升序数组中第p百分位的值
+func percentileOf(latencies []float64, p float64) float64 {
+	lt := len(latencies)
+	if lt == 0 {
+		return 0
+	}
+	fi := p * float64(lt) / 100.0
+	ii := int(fi)
+	if ii >= lt || float64(ii) == fi {
+		ii = ii - 1
+	}
+	if ii < 0 {
+		ii = 0
+	}
+	return latencies[ii]
+}
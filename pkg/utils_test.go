@@ -0,0 +1,58 @@
+package kite
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) { return 0, errors.New("read failed") }
+
+func TestHTTPClientInterceptorRequestBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name     string
+		body     func() io.Reader
+		length   int64 // -1表示长度未知
+		wantOK   bool
+		bodySize uint64 // 计入发送字节数的请求体大小
+	}{
+		{"known length", func() io.Reader { return strings.NewReader("hello") }, 5, true, 5},
+		{"unknown length", func() io.Reader { return strings.NewReader("hello world") }, -1, true, 11},
+		{"read error", func() io.Reader { return errReader{} }, -1, false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			results := make(chan *Response, 1)
+			client := &http.Client{Transport: HTTPClientInterceptor(results, http.DefaultTransport, nil)}
+			req, _ := http.NewRequest("POST", srv.URL+"/upload", ioutil.NopCloser(c.body()))
+			req.ContentLength = c.length
+			headerSize := httpRequestSize(&http.Request{Method: req.Method, URL: req.URL, Header: req.Header})
+			rsp, err := client.Do(req)
+			if err == nil {
+				rsp.Body.Close()
+			}
+			select {
+			case result := <-results:
+				if result.IsSucceed != c.wantOK {
+					t.Errorf("succeed = %v (%s), want %v", result.IsSucceed, result.ErrMsg, c.wantOK)
+				}
+				if c.wantOK && result.SentBytes != headerSize+c.bodySize {
+					t.Errorf("sent bytes = %d, want %d", result.SentBytes, headerSize+c.bodySize)
+				}
+			default:
+				t.Fatalf("no result reported (err %v)", err)
+			}
+		})
+	}
+}
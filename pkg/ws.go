@@ -0,0 +1,509 @@
+package kite
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseNormal   = 1000
+	wsCloseAbnormal = 1006 // 未收到关闭帧的异常断开
+	wsCloseTooBig   = 1009 // 消息超出长度限制
+
+	wsDefaultMaxMessageSize = 16 << 20
+
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	ErrWSClosed  = errors.New("kite: websocket closed")
+	ErrWSTimeout = errors.New("kite: websocket request timeout")
+	ErrWSTooBig  = errors.New("kite: websocket message too big")
+)
+
+type WSConfig struct {
+	Header    http.Header
+	TLSConfig *tls.Config
+	Timeout   time.Duration // 握手及等待响应的超时, 默认5秒
+	Binary    bool          // 以二进制帧发送, 默认文本帧
+	// 收到的单个消息(含分片)的最大字节数, 默认16MB, 超出时以1009关闭连接并上报断开
+	MaxMessageSize int
+	// 从收到的消息中提取关联id, ok为false表示服务端主动推送
+	Correlate func(msg []byte) (id string, ok bool)
+	// 收到服务端推送时回调, 可为nil
+	OnPush func(msg []byte)
+}
+
+// 带统计的websocket客户端连接
+// 握手延迟, 请求/响应往返, 推送消息及连接断开都会上报到results
+type WSConn struct {
+	cfg     *WSConfig
+	timeout time.Duration
+	url     string
+	conn    net.Conn
+	r       *bufio.Reader
+	maxSize uint64
+	results chan<- *Response
+
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	closing bool
+	pending map[string]chan []byte
+	done    chan struct{}
+}
+
+func wsMethod(kind, target string) string {
+	return fmt.Sprintf("[%s]%s", kind, target)
+}
+
+// 建立websocket连接, 握手结果以[HANDSHAKE]<url>上报
+func DialWS(rawurl string, cfg *WSConfig, results chan<- *Response) (*WSConn, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	startTime := time.Now()
+	c, err := dialWS(rawurl, cfg, timeout)
+	result := &Response{
+		MsgType:   MSG_WS,
+		Method:    wsMethod("HANDSHAKE", rawurl),
+		UseTime:   uint64(time.Since(startTime)),
+		IsSucceed: err == nil,
+	}
+	if err != nil {
+		result.ErrCode = ERR_CODE_REQUEST
+		result.ErrMsg = err.Error()
+	}
+	SendResponse(results, result)
+	if err != nil {
+		return nil, err
+	}
+	c.results = results
+	go c.readLoop()
+	return c, nil
+}
+
+func dialWS(rawurl string, cfg *WSConfig, timeout time.Duration) (*WSConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		tlsConfig := cfg.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, vs := range cfg.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rsp.Body.Close()
+	h := sha1.Sum([]byte(key + wsAcceptGUID))
+	if rsp.StatusCode != http.StatusSwitchingProtocols ||
+		rsp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(h[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %s", rsp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	maxSize := uint64(cfg.MaxMessageSize)
+	if maxSize == 0 {
+		maxSize = wsDefaultMaxMessageSize
+	}
+	return &WSConn{
+		cfg:     cfg,
+		timeout: timeout,
+		url:     rawurl,
+		conn:    conn,
+		r:       r,
+		maxSize: maxSize,
+		pending: make(map[string]chan []byte),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (c *WSConn) writeFrame(op byte, payload []byte) error {
+	var hdr [14]byte
+	hdr[0] = 0x80 | op
+	n, i := len(payload), 2
+	switch {
+	case n < 126:
+		hdr[1] = 0x80 | byte(n)
+	case n <= 0xffff:
+		hdr[1] = 0x80 | 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+		i = 4
+	default:
+		hdr[1] = 0x80 | 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+		i = 10
+	}
+	// 客户端发送的帧必须加掩码
+	rand.Read(hdr[i : i+4])
+	mask := hdr[i : i+4]
+	i += 4
+	buf := make([]byte, i+n)
+	copy(buf, hdr[:i])
+	for j := 0; j < n; j++ {
+		buf[i+j] = payload[j] ^ mask[j%4]
+	}
+	c.wmu.Lock()
+	_, err := c.conn.Write(buf)
+	c.wmu.Unlock()
+	return err
+}
+
+// limit为该帧允许的最大长度, 在分配内存前校验服务端声明的长度
+func (c *WSConn) readFrame(limit uint64) (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.r, hdr[:]); err != nil {
+		return
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0f
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > limit {
+		err = ErrWSTooBig
+		return
+	}
+	var mask [4]byte
+	masked := hdr[1]&0x80 != 0
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for j := range payload {
+			payload[j] ^= mask[j%4]
+		}
+	}
+	return
+}
+
+// 读取完整的数据消息, 处理分片及控制帧, 返回关闭码及错误
+func (c *WSConn) readMessage() ([]byte, int, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame(c.maxSize - uint64(len(msg)))
+		if err == ErrWSTooBig {
+			var payload [2]byte
+			binary.BigEndian.PutUint16(payload[:], wsCloseTooBig)
+			c.writeFrame(wsOpClose, payload[:])
+			// 剩余数据无法跳过, 直接断开
+			c.conn.Close()
+			return nil, wsCloseTooBig, err
+		}
+		if err != nil {
+			return nil, wsCloseAbnormal, err
+		}
+		switch op {
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.writeFrame(wsOpClose, payload)
+			return nil, code, ErrWSClosed
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			msg = append(msg, payload...)
+			if fin {
+				return msg, 0, nil
+			}
+		}
+	}
+}
+
+func (c *WSConn) readLoop() {
+	defer close(c.done)
+	for {
+		msg, code, err := c.readMessage()
+		if err != nil {
+			c.mu.Lock()
+			closing := c.closing
+			c.closing = true
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			// 非主动关闭导致的断开, 以关闭码作为错误码上报
+			if !closing {
+				SendResponse(c.results, &Response{
+					MsgType:   MSG_WS,
+					Method:    wsMethod("DISCONNECT", c.url),
+					IsSucceed: false,
+					ErrCode:   code,
+					ErrMsg:    err.Error(),
+					NoLatency: true,
+				})
+			}
+			return
+		}
+		if c.cfg.Correlate != nil {
+			if id, ok := c.cfg.Correlate(msg); ok {
+				c.mu.Lock()
+				ch := c.pending[id]
+				delete(c.pending, id)
+				c.mu.Unlock()
+				if ch != nil {
+					ch <- msg
+				}
+				continue
+			}
+		}
+		SendResponse(c.results, &Response{
+			MsgType:       MSG_WS,
+			Method:        wsMethod("PUSH", c.url),
+			IsSucceed:     true,
+			ReceivedBytes: uint64(len(msg)),
+			NoLatency:     true,
+		})
+		if c.cfg.OnPush != nil {
+			c.cfg.OnPush(msg)
+		}
+	}
+}
+
+// 发送消息并等待关联id相同的响应, 往返结果以[method]<url>上报
+func (c *WSConn) Call(method, id string, msg []byte) ([]byte, error) {
+	return c.CallContext(context.Background(), method, id, msg)
+}
+
+// 同Call, ctx结束时停止等待, ctx中的RunState填入上报的结果
+func (c *WSConn) CallContext(ctx context.Context, method, id string, msg []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return nil, ErrWSClosed
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	op := byte(wsOpText)
+	if c.cfg.Binary {
+		op = wsOpBinary
+	}
+	startTime := time.Now()
+	err := c.writeFrame(op, msg)
+	var rsp []byte
+	errCode := ERR_CODE_REQUEST
+	if err == nil {
+		timer := time.NewTimer(c.timeout)
+		select {
+		case m, ok := <-ch:
+			if ok {
+				rsp = m
+			} else {
+				err = ErrWSClosed
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			if err == context.DeadlineExceeded {
+				errCode = ERR_CODE_TIMEOUT
+			}
+		case <-timer.C:
+			err = ErrWSTimeout
+			errCode = ERR_CODE_TIMEOUT
+		}
+		timer.Stop()
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}
+	result := &Response{
+		MsgType:       MSG_WS,
+		Method:        wsMethod(method, c.url),
+		StartTime:     startTime,
+		UseTime:       uint64(time.Since(startTime)),
+		IsSucceed:     err == nil,
+		ReceivedBytes: uint64(len(rsp)),
+		SentBytes:     uint64(len(msg)),
+	}
+	if err != nil {
+		result.ErrCode = errCode
+		result.ErrMsg = err.Error()
+	}
+	FillResponse(ctx, result)
+	SendResponse(c.results, result)
+	return rsp, err
+}
+
+// 只发送不等待响应
+func (c *WSConn) Send(msg []byte) error {
+	op := byte(wsOpText)
+	if c.cfg.Binary {
+		op = wsOpBinary
+	}
+	return c.writeFrame(op, msg)
+}
+
+// 主动关闭连接, 不计为断开
+func (c *WSConn) Close() error {
+	c.mu.Lock()
+	closing := c.closing
+	c.closing = true
+	c.mu.Unlock()
+	if !closing {
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], wsCloseNormal)
+		c.writeFrame(wsOpClose, payload[:])
+		// 等待服务端回复关闭帧, 超时则直接断开
+		select {
+		case <-c.done:
+		case <-time.After(time.Second):
+		}
+	}
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// websocket压测配置, 每个worker维持一个长连接, 每次OnRequest发起一次Call
+type WSHandlerConfig struct {
+	WSConfig
+	Method string // 统计中的命令字, 默认为CALL
+	// 生成第seq个请求的关联id及消息内容
+	NewMessage func(seq int) (id string, msg []byte)
+}
+
+type wsHandler struct {
+	cfg  *WSHandlerConfig
+	conn *WSConn
+	seq  int
+}
+
+func NewWSHandler(cfg *WSHandlerConfig) NewReqHandlerFunc {
+	if cfg.Method == "" {
+		cfg.Method = "CALL"
+	}
+	// 默认按回显服务处理: 消息内容即关联id
+	if cfg.Correlate == nil {
+		cfg.Correlate = func(msg []byte) (string, bool) {
+			return string(msg), true
+		}
+	}
+	if cfg.NewMessage == nil {
+		cfg.NewMessage = func(seq int) (string, []byte) {
+			id := strconv.Itoa(seq)
+			return id, []byte(id)
+		}
+	}
+	return func() ReqHandler {
+		return &wsHandler{cfg: cfg}
+	}
+}
+
+func (h *wsHandler) Init(req *Request, results chan<- *Response) error {
+	conn, err := DialWS(req.Url, &h.cfg.WSConfig, results)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+func (h *wsHandler) OnRequest() error {
+	return h.OnRequestContext(context.Background())
+}
+
+func (h *wsHandler) OnRequestContext(ctx context.Context) error {
+	h.seq++
+	id, msg := h.cfg.NewMessage(h.seq)
+	_, err := h.conn.CallContext(ctx, h.cfg.Method, id, msg)
+	return err
+}
+
+func (h *wsHandler) Close() {
+	h.conn.Close()
+}